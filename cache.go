@@ -0,0 +1,303 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// hashCacheVersion is bumped whenever the on-disk format of the cache changes.
+const hashCacheVersion = 2
+
+// defaultHashCachePath returns the path of the hash cache in the user cache directory
+// (i.e. $XDG_CACHE_HOME on linux and ~/Library/Caches on darwin).
+func defaultHashCachePath() (string, error) {
+	cacheDir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(cacheDir, "space-saver", "hashes.json"), nil
+}
+
+// defaultCheckpointPath returns the path of the checkpoint for a scan of a given set of targets
+// in the user cache directory.
+func defaultCheckpointPath(targets []string) (string, error) {
+	cacheDir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	name, err := pathsFileName(targets)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(cacheDir, "space-saver", "checkpoints", name), nil
+}
+
+// pathsFileName returns the name of a file that's named for a given set of paths (e.g. the targets of a scan).
+func pathsFileName(paths []string) (string, error) {
+	h := sha256.New()
+	for _, path := range paths {
+		pathAbsolute, err := filepath.Abs(path)
+		if err != nil {
+			return "", err
+		}
+		_, _ = io.WriteString(h, pathAbsolute+"\x00")
+	}
+	return hex.EncodeToString(h.Sum(nil))[:16] + ".json", nil
+}
+
+// hashCacheKey identifies a specific version of a specific file.
+//
+// If any of these fields change we assume the contents of the file may have changed.
+type hashCacheKey struct {
+	Dev     uint64 `json:"dev"`
+	Ino     uint64 `json:"ino"`
+	Size    int64  `json:"size"`
+	ModTime int64  `json:"mtime"`
+	Ctime   int64  `json:"ctime"`
+}
+
+// hashCacheEntry are the cached checksums of a file along with the path they were computed for.
+//
+// Checksums are keyed by the name of the algorithm (and stage) that computed them,
+// so checksums from different algorithms are never mixed.
+type hashCacheEntry struct {
+	hashCacheKey
+	Path      string            `json:"path"`
+	Checksums map[string]string `json:"checksums"`
+}
+
+type hashCacheFile struct {
+	Version int              `json:"version"`
+	Entries []hashCacheEntry `json:"entries"`
+}
+
+// hashCache is a persistent cache of file checksums.
+//
+// It's used both as the long lived cache shared between runs and as the checkpoint of an interrupted scan.
+//
+// It is safe to use from multiple goroutines.
+type hashCache struct {
+	path string
+
+	mu      sync.Mutex
+	entries map[hashCacheKey]hashCacheEntry
+	hits    int
+	misses  int
+	dirty   bool
+}
+
+// newHashCache returns an empty hash cache that will be saved to a given path.
+func newHashCache(path string) *hashCache {
+	return &hashCache{
+		path:    path,
+		entries: make(map[hashCacheKey]hashCacheEntry),
+	}
+}
+
+// openHashCache reads a hash cache from a given path.
+//
+// A missing file is treated as an empty cache, and will be created on save. So is a file that can't be parsed
+// (e.g. one truncated by a crash), with a warning, as the cache can always be regenerated.
+func openHashCache(path string) (*hashCache, error) {
+	hc := newHashCache(path)
+	contents, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return hc, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("hash cache: unable to read %s; %w", path, err)
+	}
+	var file hashCacheFile
+	if err := json.Unmarshal(contents, &file); err != nil {
+		fmt.Fprintf(os.Stderr, "hash cache: unable to parse %s, starting with an empty cache; %v\n", path, err)
+		hc.dirty = true
+		return hc, nil
+	}
+	if file.Version != hashCacheVersion {
+		// an old format cache is just thrown away.
+		hc.dirty = true
+		return hc, nil
+	}
+	for _, entry := range file.Entries {
+		hc.entries[entry.hashCacheKey] = entry
+	}
+	return hc, nil
+}
+
+// hashCacheKeyOf returns the cache key for a file.
+func hashCacheKeyOf(info fs.FileInfo) (hashCacheKey, bool) {
+	st, ok := statOf(info)
+	if !ok {
+		return hashCacheKey{}, false
+	}
+	return hashCacheKey{
+		Dev:     st.Dev,
+		Ino:     st.Ino,
+		Size:    info.Size(),
+		ModTime: info.ModTime().UnixNano(),
+		Ctime:   st.Ctime,
+	}, true
+}
+
+// Get returns the checksum of a file computed by a given algorithm if the file hasn't changed since it was cached.
+func (hc *hashCache) Get(ffi fullFileInfo, algorithm string) (checksum string, ok bool) {
+	key, ok := hashCacheKeyOf(ffi)
+	if !ok {
+		return "", false
+	}
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+	entry, ok := hc.entries[key]
+	if ok {
+		checksum, ok = entry.Checksums[algorithm]
+	}
+	if !ok {
+		hc.misses++
+		return "", false
+	}
+	hc.hits++
+	if entry.Path != ffi.Path {
+		entry.Path = ffi.Path
+		hc.entries[key] = entry
+		hc.dirty = true
+	}
+	return checksum, true
+}
+
+// Put adds the checksum of a file computed by a given algorithm to the cache.
+func (hc *hashCache) Put(ffi fullFileInfo, algorithm, checksum string) {
+	key, ok := hashCacheKeyOf(ffi)
+	if !ok {
+		return
+	}
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+	entry, ok := hc.entries[key]
+	if !ok {
+		entry = hashCacheEntry{hashCacheKey: key}
+	} else if entry.Path == ffi.Path && entry.Checksums[algorithm] == checksum {
+		// nothing has changed, so there's nothing to save.
+		return
+	}
+	if entry.Checksums == nil {
+		entry.Checksums = make(map[string]string)
+	}
+	entry.Path = ffi.Path
+	entry.Checksums[algorithm] = checksum
+	hc.entries[key] = entry
+	hc.dirty = true
+}
+
+// Len returns the number of entries in the cache.
+func (hc *hashCache) Len() int {
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+	return len(hc.entries)
+}
+
+// Stats returns the number of lookups that were hits and misses since the cache was opened.
+func (hc *hashCache) Stats() (hits, misses int) {
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+	return hc.hits, hc.misses
+}
+
+// Prune removes entries for files that no longer exist or have changed since they were cached,
+// and returns the number of entries removed.
+func (hc *hashCache) Prune() (removed int) {
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+	for key, entry := range hc.entries {
+		info, err := os.Stat(entry.Path)
+		if err == nil {
+			if current, ok := hashCacheKeyOf(info); ok && current == key {
+				continue
+			}
+		}
+		delete(hc.entries, key)
+		removed++
+	}
+	if removed > 0 {
+		hc.dirty = true
+	}
+	return
+}
+
+// Save writes the cache to disk if it has changed.
+//
+// The cache is written to a temporary file and renamed into place so a crash mid-save
+// never leaves a truncated cache behind.
+func (hc *hashCache) Save() error {
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+	if !hc.dirty {
+		return nil
+	}
+	file := hashCacheFile{
+		Version: hashCacheVersion,
+		Entries: make([]hashCacheEntry, 0, len(hc.entries)),
+	}
+	for _, entry := range hc.entries {
+		file.Entries = append(file.Entries, entry)
+	}
+	contents, err := json.Marshal(file)
+	if err != nil {
+		return fmt.Errorf("hash cache: unable to serialize; %w", err)
+	}
+	if err := writeFileAtomic(hc.path, contents); err != nil {
+		return fmt.Errorf("hash cache: unable to write %s; %w", hc.path, err)
+	}
+	hc.dirty = false
+	return nil
+}
+
+// Remove deletes the cache file from disk, if it exists.
+func (hc *hashCache) Remove() error {
+	if err := os.Remove(hc.path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("hash cache: unable to remove %s; %w", hc.path, err)
+	}
+	return nil
+}
+
+// writeFileAtomic writes contents to a temporary sibling of path and renames it into place,
+// creating the parent directory if it doesn't exist.
+func writeFileAtomic(path string, contents []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	tempPath, err := tempSiblingPath(path)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(tempPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(contents); err != nil {
+		_ = f.Close()
+		_ = os.Remove(tempPath)
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		_ = f.Close()
+		_ = os.Remove(tempPath)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		_ = os.Remove(tempPath)
+		return err
+	}
+	if err := os.Rename(tempPath, path); err != nil {
+		_ = os.Remove(tempPath)
+		return err
+	}
+	return syncDir(filepath.Dir(path))
+}
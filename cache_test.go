@@ -0,0 +1,104 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func Test_hashCache(t *testing.T) {
+	tempDir := t.TempDir()
+	path := filepath.Join(tempDir, "file")
+	if err := os.WriteFile(path, []byte("hello world"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ffi := fullFileInfo{Path: path, FileInfo: info}
+
+	cachePath := filepath.Join(tempDir, "cache", "hashes.json")
+	cache, err := openHashCache(cachePath)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, ok := cache.Get(ffi, "sha256"); ok {
+		t.Errorf("Expected a miss on an empty cache")
+	}
+	cache.Put(ffi, "sha256", "checksum")
+	if err := cache.Save(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	cache, err = openHashCache(cachePath)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if actual, ok := cache.Get(ffi, "sha256"); !ok || actual != "checksum" {
+		t.Errorf("Expected=checksum vs. Actual=%s (%v)", actual, ok)
+	}
+
+	later := info.ModTime().Add(time.Second)
+	if err := os.Chtimes(path, later, later); err != nil {
+		t.Fatal(err)
+	}
+	info, err = os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := cache.Get(fullFileInfo{Path: path, FileInfo: info}, "sha256"); ok {
+		t.Errorf("Expected a miss after the file changed")
+	}
+	if removed := cache.Prune(); removed != 1 {
+		t.Errorf("Expected=1 pruned vs. Actual=%d", removed)
+	}
+}
+
+func Test_hashCache_algorithms(t *testing.T) {
+	tempDir := t.TempDir()
+	path := filepath.Join(tempDir, "file")
+	if err := os.WriteFile(path, []byte("hello world"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ffi := fullFileInfo{Path: path, FileInfo: info}
+
+	cache := newHashCache(filepath.Join(tempDir, "hashes.json"))
+	cache.Put(ffi, "sha256", "sha256-checksum")
+	if _, ok := cache.Get(ffi, "sha1"); ok {
+		t.Errorf("Expected a miss for a different algorithm")
+	}
+	cache.Put(ffi, "sha1", "sha1-checksum")
+	if actual, _ := cache.Get(ffi, "sha256"); actual != "sha256-checksum" {
+		t.Errorf("Expected=sha256-checksum vs. Actual=%s", actual)
+	}
+	if actual, _ := cache.Get(ffi, "sha1"); actual != "sha1-checksum" {
+		t.Errorf("Expected=sha1-checksum vs. Actual=%s", actual)
+	}
+}
+
+func Test_hashCache_corrupt(t *testing.T) {
+	cachePath := filepath.Join(t.TempDir(), "hashes.json")
+	if err := os.WriteFile(cachePath, []byte(`{"version":2,"entries":[`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cache, err := openHashCache(cachePath)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if actual := cache.Len(); actual != 0 {
+		t.Errorf("Expected=0 entries vs. Actual=%d", actual)
+	}
+	// the empty cache replaces the corrupt one on save.
+	if err := cache.Save(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := openHashCache(cachePath); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// tempSuffix marks the temporary siblings we clone into before renaming over a target.
+const tempSuffix = ".space-saver-tmp"
+
+// cloneFile replaces target with a clone of source.
+//
+// The clone is made into a temporary sibling of the target which is then renamed over
+// the target, so that a failed or interrupted clone never loses the original file.
+//
+// If the target exists, its metadata is restored onto the clone before it's renamed into place,
+// and anything that couldn't be restored is returned as problems.
+func cloneFile(source, target string) (problems []metadataProblem, err error) {
+	sourceAbsolute, err := filepath.Abs(source)
+	if err != nil {
+		return nil, fmt.Errorf("clone-file failed: unable to make source path absolute; %w", err)
+	}
+	targetAbsolute, err := filepath.Abs(target)
+	if err != nil {
+		return nil, fmt.Errorf("clone-file failed: unable to make target path absolute; %w", err)
+	}
+	if !fileExists(sourceAbsolute) {
+		return nil, fmt.Errorf("clone-file failed: source not found; %s", sourceAbsolute)
+	}
+	targetInfo, err := os.Stat(targetAbsolute)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("clone-file failed: unable to stat target; %w", err)
+	}
+	tempPath, err := tempSiblingPath(targetAbsolute)
+	if err != nil {
+		return nil, fmt.Errorf("clone-file failed: unable to create temporary path; %w", err)
+	}
+	if err := clonefile(sourceAbsolute, tempPath); err != nil {
+		return nil, fmt.Errorf("clone-file failed: %w", err)
+	}
+	if targetInfo != nil {
+		problems = restoreMetadata(targetInfo, targetAbsolute, tempPath)
+	}
+	if err := os.Rename(tempPath, targetAbsolute); err != nil {
+		_ = os.Remove(tempPath)
+		return nil, fmt.Errorf("clone-file failed: unable to replace target; %w", err)
+	}
+	if err := syncDir(filepath.Dir(targetAbsolute)); err != nil {
+		return problems, fmt.Errorf("clone-file failed: unable to sync target directory; %w", err)
+	}
+	return problems, nil
+}
+
+// tempSiblingPath returns a unique, hidden path in the same directory as target.
+//
+// It has to be in the same directory so that it's on the same filesystem and can be renamed over the target.
+func tempSiblingPath(target string) (string, error) {
+	nonce := make([]byte, 6)
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	base := filepath.Base(target)
+	if len(base) > 128 {
+		base = base[:128]
+	}
+	return filepath.Join(filepath.Dir(target), "."+base+"."+hex.EncodeToString(nonce)+tempSuffix), nil
+}
+
+// removeTempSiblings removes any temporary siblings of a target left behind by an interrupted replacement,
+// returning the paths that were removed.
+func removeTempSiblings(target string) (removed []string, err error) {
+	entries, err := os.ReadDir(filepath.Dir(target))
+	if err != nil {
+		return nil, err
+	}
+	base := filepath.Base(target)
+	if len(base) > 128 {
+		base = base[:128]
+	}
+	prefix := "." + base + "."
+	for _, entry := range entries {
+		name := entry.Name()
+		if !strings.HasPrefix(name, prefix) || !strings.HasSuffix(name, tempSuffix) {
+			continue
+		}
+		// the nonce is 6 bytes of hex.
+		if nonce := strings.TrimSuffix(strings.TrimPrefix(name, prefix), tempSuffix); len(nonce) != 12 {
+			continue
+		} else if _, err := hex.DecodeString(nonce); err != nil {
+			continue
+		}
+		path := filepath.Join(filepath.Dir(target), name)
+		if err := os.Remove(path); err != nil {
+			return removed, err
+		}
+		removed = append(removed, path)
+	}
+	return removed, nil
+}
+
+// syncDir flushes a directory so that a rename within it is durable.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
@@ -0,0 +1,10 @@
+package main
+
+import "golang.org/x/sys/unix"
+
+// clonefile creates target as a copy-on-write clone of source.
+//
+// On darwin this is clonefile(2), which is supported by APFS.
+func clonefile(source, target string) error {
+	return unix.Clonefile(source, target, unix.CLONE_NOFOLLOW)
+}
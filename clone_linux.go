@@ -0,0 +1,38 @@
+package main
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// clonefile creates target as a copy-on-write clone of source.
+//
+// On linux this is the FICLONE ioctl, which is supported by btrfs and XFS (among others).
+// The target is created with the permission bits of the source to match darwin clonefile(2).
+func clonefile(source, target string) error {
+	sourceFile, err := os.Open(source)
+	if err != nil {
+		return err
+	}
+	defer sourceFile.Close()
+	sourceInfo, err := sourceFile.Stat()
+	if err != nil {
+		return err
+	}
+	targetFile, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_EXCL, sourceInfo.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	if err := unix.IoctlFileClone(int(targetFile.Fd()), int(sourceFile.Fd())); err != nil {
+		_ = targetFile.Close()
+		_ = os.Remove(target)
+		return err
+	}
+	if err := targetFile.Sync(); err != nil {
+		_ = targetFile.Close()
+		_ = os.Remove(target)
+		return err
+	}
+	return targetFile.Close()
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/wcharczuk/space-saver/pkg/filesize"
+)
+
+// maxDedupeRangeLength is the largest range we'll ask the kernel to dedupe in a single call.
+//
+// Some filesystems (btrfs) silently cap each request at 16MiB, so we walk the file in chunks of that size.
+const maxDedupeRangeLength = 16 << 20
+
+type dedupeStatus int
+
+const (
+	dedupeSame dedupeStatus = iota
+	dedupeDiffers
+	dedupeFailed
+)
+
+func (ds dedupeStatus) String() string {
+	switch ds {
+	case dedupeSame:
+		return "same"
+	case dedupeDiffers:
+		return "differs"
+	case dedupeFailed:
+		return "error"
+	default:
+		return fmt.Sprintf("unknown(%d)", int(ds))
+	}
+}
+
+// dedupeRange is the kernel reported outcome of deduping a single range of a file.
+type dedupeRange struct {
+	Offset       uint64
+	Length       uint64
+	BytesDeduped uint64
+	Status       dedupeStatus
+	Err          error
+}
+
+// dedupeResult is the outcome of deduping a target file against a source file.
+type dedupeResult struct {
+	Ranges []dedupeRange
+}
+
+// BytesDeduped returns the total bytes the kernel reports as now shared.
+func (dr dedupeResult) BytesDeduped() (total uint64) {
+	for _, r := range dr.Ranges {
+		total += r.BytesDeduped
+	}
+	return
+}
+
+// Count returns the number of ranges with a given status.
+func (dr dedupeResult) Count(status dedupeStatus) (count int) {
+	for _, r := range dr.Ranges {
+		if r.Status == status {
+			count++
+		}
+	}
+	return
+}
+
+func printDedupeResult(w io.Writer, source, target string, result dedupeResult) {
+	fmt.Fprintf(w, "Deduped %s to %s: %d same, %d differs, %d error (%s shared)\n",
+		truncateStringPrefix(source, 64),
+		truncateStringPrefix(target, 64),
+		result.Count(dedupeSame),
+		result.Count(dedupeDiffers),
+		result.Count(dedupeFailed),
+		filesize.Format(result.BytesDeduped()),
+	)
+	for _, r := range result.Ranges {
+		if r.Status == dedupeSame {
+			continue
+		}
+		if r.Err != nil {
+			fmt.Fprintf(w, "\trange offset=%d length=%d status=%v; %v\n", r.Offset, r.Length, r.Status, r.Err)
+			continue
+		}
+		fmt.Fprintf(w, "\trange offset=%d length=%d status=%v\n", r.Offset, r.Length, r.Status)
+	}
+}
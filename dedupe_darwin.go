@@ -0,0 +1,11 @@
+package main
+
+import "errors"
+
+// dedupeSupported is false on darwin, which has no equivalent to FIDEDUPERANGE.
+const dedupeSupported = false
+
+// dedupeFile is not supported on darwin.
+func dedupeFile(_, _ string) (dedupeResult, error) {
+	return dedupeResult{}, errors.New("dedupe failed: not supported on darwin")
+}
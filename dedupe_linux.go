@@ -0,0 +1,94 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// dedupeSupported is true on linux.
+const dedupeSupported = true
+
+// dedupeFile asks the kernel to share the extents of source with target using the FIDEDUPERANGE ioctl.
+//
+// The kernel compares the bytes of each range under lock and only shares extents if they're identical,
+// so the target inode (and its ownership, permissions, links and open handles) is left untouched.
+// We stop at the first range that doesn't come back as the same.
+func dedupeFile(source, target string) (result dedupeResult, err error) {
+	sourceFile, err := os.Open(source)
+	if err != nil {
+		return
+	}
+	defer sourceFile.Close()
+	targetFile, err := openDedupeTarget(target)
+	if err != nil {
+		return
+	}
+	defer targetFile.Close()
+
+	sourceInfo, err := sourceFile.Stat()
+	if err != nil {
+		return
+	}
+	targetInfo, err := targetFile.Stat()
+	if err != nil {
+		return
+	}
+	size := uint64(sourceInfo.Size())
+	if size != uint64(targetInfo.Size()) {
+		result.Ranges = append(result.Ranges, dedupeRange{Length: size, Status: dedupeDiffers})
+		return
+	}
+
+	var offset uint64
+	for offset < size {
+		length := min(size-offset, maxDedupeRangeLength)
+		dr := unix.FileDedupeRange{
+			Src_offset: offset,
+			Src_length: length,
+			Info: []unix.FileDedupeRangeInfo{{
+				Dest_fd:     int64(targetFile.Fd()),
+				Dest_offset: offset,
+			}},
+		}
+		if err = unix.IoctlFileDedupeRange(int(sourceFile.Fd()), &dr); err != nil {
+			err = fmt.Errorf("dedupe failed: %w", err)
+			return
+		}
+		info := dr.Info[0]
+		r := dedupeRange{Offset: offset, Length: length, BytesDeduped: info.Bytes_deduped}
+		switch {
+		case info.Status == unix.FILE_DEDUPE_RANGE_SAME:
+			r.Status = dedupeSame
+		case info.Status == unix.FILE_DEDUPE_RANGE_DIFFERS:
+			r.Status = dedupeDiffers
+		default:
+			r.Status = dedupeFailed
+			r.Err = syscall.Errno(-info.Status)
+		}
+		result.Ranges = append(result.Ranges, r)
+		if r.Status != dedupeSame {
+			return
+		}
+		if info.Bytes_deduped > 0 {
+			offset += info.Bytes_deduped
+		} else {
+			offset += length
+		}
+	}
+	return
+}
+
+// openDedupeTarget opens the target for writing if we can, and falls back to read only
+// (which newer kernels accept if we own the file).
+func openDedupeTarget(target string) (*os.File, error) {
+	f, err := os.OpenFile(target, os.O_WRONLY, 0)
+	if errors.Is(err, fs.ErrPermission) {
+		return os.Open(target)
+	}
+	return f, err
+}
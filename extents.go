@@ -0,0 +1,133 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"slices"
+)
+
+// extent is a range of a file's physical storage.
+type extent struct {
+	Physical uint64
+	Length   uint64
+}
+
+// sharingKind classifies how much of a file's storage is shared with another file.
+type sharingKind int
+
+const (
+	sharingNone sharingKind = iota
+	sharingPartial
+	sharingFull
+)
+
+func (sk sharingKind) String() string {
+	switch sk {
+	case sharingNone:
+		return "unshared"
+	case sharingPartial:
+		return "partially shared"
+	case sharingFull:
+		return "fully shared"
+	default:
+		return fmt.Sprintf("unknown(%d)", int(sk))
+	}
+}
+
+// extentSharing is how many bytes of a file share physical storage with another file.
+type extentSharing struct {
+	Size        uint64
+	SharedBytes uint64
+	// HardLink is true if the files are the same inode.
+	HardLink bool
+}
+
+// Kind returns the classification of the sharing.
+func (es extentSharing) Kind() sharingKind {
+	switch {
+	case es.HardLink || (es.Size > 0 && es.SharedBytes >= es.Size):
+		return sharingFull
+	case es.SharedBytes > 0:
+		return sharingPartial
+	default:
+		return sharingNone
+	}
+}
+
+// Reclaimable returns the bytes that could still be saved by sharing the rest of the file.
+func (es extentSharing) Reclaimable() uint64 {
+	if es.Kind() == sharingFull {
+		return 0
+	}
+	return es.Size - es.SharedBytes
+}
+
+// Percent returns the percentage of the file that is shared.
+func (es extentSharing) Percent() float64 {
+	if es.Kind() == sharingFull {
+		return 100
+	}
+	if es.Size == 0 {
+		return 0
+	}
+	return 100 * float64(es.SharedBytes) / float64(es.Size)
+}
+
+// fileSharing returns how much of the target file shares physical storage with the source file.
+//
+// If the platform can't report extents, files that aren't hard links are assumed to be unshared.
+func fileSharing(source, target fullFileInfo) (sharing extentSharing, err error) {
+	sharing.Size = uint64(target.Size())
+	if os.SameFile(source.FileInfo, target.FileInfo) {
+		sharing.HardLink = true
+		sharing.SharedBytes = sharing.Size
+		return
+	}
+	if !extentsSupported {
+		return
+	}
+	sourceExtents, err := fileExtents(source.Path)
+	if err != nil {
+		return
+	}
+	targetExtents, err := fileExtents(target.Path)
+	if err != nil {
+		return
+	}
+	sharing.SharedBytes = min(sharedBytes(sourceExtents, targetExtents), sharing.Size)
+	return
+}
+
+// sharedBytes returns the number of bytes of physical storage that appear in both sets of extents.
+func sharedBytes(a, b []extent) (shared uint64) {
+	a, b = sortedExtents(a), sortedExtents(b)
+	var i, j int
+	for i < len(a) && j < len(b) {
+		aEnd, bEnd := a[i].Physical+a[i].Length, b[j].Physical+b[j].Length
+		start, end := max(a[i].Physical, b[j].Physical), min(aEnd, bEnd)
+		if end > start {
+			shared += end - start
+		}
+		if aEnd < bEnd {
+			i++
+		} else {
+			j++
+		}
+	}
+	return
+}
+
+func sortedExtents(extents []extent) []extent {
+	extents = slices.Clone(extents)
+	slices.SortFunc(extents, func(a, b extent) int {
+		switch {
+		case a.Physical < b.Physical:
+			return -1
+		case a.Physical > b.Physical:
+			return 1
+		default:
+			return 0
+		}
+	})
+	return extents
+}
@@ -0,0 +1,11 @@
+package main
+
+import "errors"
+
+// extentsSupported is false on darwin, which has no equivalent to FIEMAP.
+const extentsSupported = false
+
+// fileExtents is not supported on darwin.
+func fileExtents(_ string) ([]extent, error) {
+	return nil, errors.New("file extents: not supported on darwin")
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// extentsSupported is true on linux.
+const extentsSupported = true
+
+const (
+	// fsIocFiemap is _IOWR('f', 11, struct fiemap).
+	fsIocFiemap = 0xC020660B
+
+	fiemapExtentLast       = 0x00000001
+	fiemapExtentUnknown    = 0x00000002
+	fiemapExtentDelalloc   = 0x00000004
+	fiemapExtentEncoded    = 0x00000008
+	fiemapExtentDataInline = 0x00000200
+
+	// fiemapBatchSize is the number of extents requested per ioctl.
+	fiemapBatchSize = 128
+)
+
+// fiemapExtent mirrors struct fiemap_extent from linux/fiemap.h.
+type fiemapExtent struct {
+	Logical    uint64
+	Physical   uint64
+	Length     uint64
+	Reserved64 [2]uint64
+	Flags      uint32
+	Reserved   [3]uint32
+}
+
+// fiemap mirrors struct fiemap from linux/fiemap.h, with room for a batch of extents.
+type fiemap struct {
+	Start         uint64
+	Length        uint64
+	Flags         uint32
+	MappedExtents uint32
+	ExtentCount   uint32
+	Reserved      uint32
+	Extents       [fiemapBatchSize]fiemapExtent
+}
+
+// fileExtents returns the physical extents of a file using the FIEMAP ioctl.
+//
+// Extents whose physical location isn't known yet (e.g. delayed allocation) or isn't
+// meaningful (e.g. inline or encoded data) are left out, so they never count as shared.
+func fileExtents(path string) (extents []extent, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	var fm fiemap
+	var start uint64
+	for {
+		fm = fiemap{
+			Start:       start,
+			Length:      ^uint64(0) - start,
+			ExtentCount: fiemapBatchSize,
+		}
+		_, _, errno := unix.Syscall(unix.SYS_IOCTL, f.Fd(), fsIocFiemap, uintptr(unsafe.Pointer(&fm)))
+		if errno != 0 {
+			err = fmt.Errorf("file extents: %w", errno)
+			return
+		}
+		if fm.MappedExtents == 0 {
+			return
+		}
+		for _, fe := range fm.Extents[:fm.MappedExtents] {
+			if fe.Flags&(fiemapExtentUnknown|fiemapExtentDelalloc|fiemapExtentEncoded|fiemapExtentDataInline) == 0 {
+				extents = append(extents, extent{Physical: fe.Physical, Length: fe.Length})
+			}
+		}
+		last := fm.Extents[fm.MappedExtents-1]
+		if last.Flags&fiemapExtentLast != 0 {
+			return
+		}
+		start = last.Logical + last.Length
+	}
+}
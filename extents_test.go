@@ -0,0 +1,42 @@
+package main
+
+import "testing"
+
+func Test_sharedBytes(t *testing.T) {
+	testCases := [...]struct {
+		A        []extent
+		B        []extent
+		Expected uint64
+	}{
+		{nil, nil, 0},
+		{[]extent{{0, 100}}, []extent{{100, 100}}, 0},
+		{[]extent{{0, 100}}, []extent{{0, 100}}, 100},
+		{[]extent{{0, 100}}, []extent{{50, 100}}, 50},
+		{[]extent{{200, 100}, {0, 100}}, []extent{{0, 300}}, 200},
+		{[]extent{{0, 50}, {50, 50}}, []extent{{25, 50}}, 50},
+	}
+
+	for _, tc := range testCases {
+		if actual := sharedBytes(tc.A, tc.B); actual != tc.Expected {
+			t.Errorf("A=%v B=%v Expected=%d vs. Actual=%d", tc.A, tc.B, tc.Expected, actual)
+		}
+	}
+}
+
+func Test_extentSharing_Kind(t *testing.T) {
+	testCases := [...]struct {
+		Input    extentSharing
+		Expected sharingKind
+	}{
+		{extentSharing{Size: 100}, sharingNone},
+		{extentSharing{Size: 100, SharedBytes: 40}, sharingPartial},
+		{extentSharing{Size: 100, SharedBytes: 100}, sharingFull},
+		{extentSharing{Size: 100, HardLink: true}, sharingFull},
+	}
+
+	for _, tc := range testCases {
+		if actual := tc.Input.Kind(); actual != tc.Expected {
+			t.Errorf("Input=%+v Expected=%v vs. Actual=%v", tc.Input, tc.Expected, actual)
+		}
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"path/filepath"
+
+	"github.com/wcharczuk/space-saver/pkg/ignore"
+)
+
+// ignoreFileName is the name of the per directory ignore files we honor,
+// which use gitignore style patterns relative to the directory they're in.
+const ignoreFileName = ".spacesaverignore"
+
+// walkFilter decides which paths of a walk are considered.
+type walkFilter struct {
+	root    string
+	include ignore.Matcher
+	exclude ignore.Matcher
+	ignores ignore.Matcher
+}
+
+// newWalkFilter returns a filter for a walk of a given root with include and exclude patterns
+// which are relative to the root.
+func newWalkFilter(root string, include, exclude []string) *walkFilter {
+	wf := &walkFilter{root: root}
+	for _, line := range include {
+		if p, ok := ignore.ParsePattern(line, ""); ok {
+			wf.include.Add(p)
+		}
+	}
+	for _, line := range exclude {
+		if p, ok := ignore.ParsePattern(line, ""); ok {
+			wf.exclude.Add(p)
+		}
+	}
+	return wf
+}
+
+// SkipDir returns if a directory should be pruned from the walk.
+//
+// If the directory isn't skipped, its ignore file (if any) is loaded
+// and applies to everything beneath it.
+func (wf *walkFilter) SkipDir(path string) (bool, error) {
+	rel := wf.rel(path)
+	if rel != "." && (wf.exclude.Match(rel, true) || wf.ignores.Match(rel, true)) {
+		return true, nil
+	}
+	patterns, err := ignore.ReadFile(filepath.Join(path, ignoreFileName), rel)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return false, nil
+		}
+		return false, err
+	}
+	wf.ignores.Add(patterns...)
+	return false, nil
+}
+
+// SkipFile returns if a file should be left out of the walk.
+func (wf *walkFilter) SkipFile(path string) bool {
+	rel := wf.rel(path)
+	if wf.exclude.Match(rel, false) || wf.ignores.Match(rel, false) {
+		return true
+	}
+	return wf.include.Len() > 0 && !wf.include.Match(rel, false)
+}
+
+func (wf *walkFilter) rel(path string) string {
+	rel, err := filepath.Rel(wf.root, path)
+	if err != nil {
+		return filepath.ToSlash(path)
+	}
+	return filepath.ToSlash(rel)
+}
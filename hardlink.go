@@ -0,0 +1,64 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// errHardlinkUnsafe is returned when a target can't be safely replaced with a hard link to its source.
+var errHardlinkUnsafe = errors.New("unsafe to hard link")
+
+// hardlinkFile replaces target with a hard link to source.
+//
+// The link is made at a temporary sibling of the target which is then renamed over
+// the target, so that the target path always refers to either the original or the source.
+func hardlinkFile(source, target string) error {
+	sourceAbsolute, err := filepath.Abs(source)
+	if err != nil {
+		return fmt.Errorf("hardlink failed: unable to make source path absolute; %w", err)
+	}
+	targetAbsolute, err := filepath.Abs(target)
+	if err != nil {
+		return fmt.Errorf("hardlink failed: unable to make target path absolute; %w", err)
+	}
+	tempPath, err := tempSiblingPath(targetAbsolute)
+	if err != nil {
+		return fmt.Errorf("hardlink failed: unable to create temporary path; %w", err)
+	}
+	if err := os.Link(sourceAbsolute, tempPath); err != nil {
+		return fmt.Errorf("hardlink failed: %w", err)
+	}
+	if err := os.Rename(tempPath, targetAbsolute); err != nil {
+		_ = os.Remove(tempPath)
+		return fmt.Errorf("hardlink failed: unable to replace target; %w", err)
+	}
+	if err := syncDir(filepath.Dir(targetAbsolute)); err != nil {
+		return fmt.Errorf("hardlink failed: unable to sync target directory; %w", err)
+	}
+	return nil
+}
+
+// checkHardlinkSafe returns an error if replacing the target with a hard link to the source
+// would change who can read or write it, or (if readOnly is set) if either file is writable.
+//
+// A hard link shares the inode of the source, so unlike a clone the target can't keep its own metadata.
+func checkHardlinkSafe(source, target fs.FileInfo, readOnly bool) error {
+	sourceStat, ok := statOf(source)
+	if !ok {
+		return fmt.Errorf("%w: unable to read owner", errHardlinkUnsafe)
+	}
+	targetStat, _ := statOf(target)
+	if sourceStat.Uid != targetStat.Uid || sourceStat.Gid != targetStat.Gid {
+		return fmt.Errorf("%w: owners differ (%d:%d vs. %d:%d)", errHardlinkUnsafe, sourceStat.Uid, sourceStat.Gid, targetStat.Uid, targetStat.Gid)
+	}
+	if source.Mode() != target.Mode() {
+		return fmt.Errorf("%w: modes differ (%v vs. %v)", errHardlinkUnsafe, source.Mode(), target.Mode())
+	}
+	if readOnly && source.Mode()&0222 != 0 {
+		return fmt.Errorf("%w: writable (%v)", errHardlinkUnsafe, source.Mode())
+	}
+	return nil
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func Test_hardlinkFile(t *testing.T) {
+	tempDir := t.TempDir()
+
+	testCases := [...]struct {
+		SourceMode fs.FileMode
+		TargetMode fs.FileMode
+		ReadOnly   bool
+		Expected   bool
+	}{
+		{0644, 0644, false, true},
+		{0644, 0600, false, false},
+		{0644, 0644, true, false},
+		{0444, 0444, true, true},
+	}
+
+	for index, tc := range testCases {
+		source, target := filepath.Join(tempDir, "source"), filepath.Join(tempDir, "target")
+		for path, mode := range map[string]fs.FileMode{source: tc.SourceMode, target: tc.TargetMode} {
+			_ = os.Remove(path)
+			if err := os.WriteFile(path, []byte("hello world"), 0600); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Chmod(path, mode); err != nil {
+				t.Fatal(err)
+			}
+		}
+		sourceInfo, err := os.Stat(source)
+		if err != nil {
+			t.Fatal(err)
+		}
+		targetInfo, err := os.Stat(target)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = checkHardlinkSafe(sourceInfo, targetInfo, tc.ReadOnly)
+		if actual := err == nil; actual != tc.Expected {
+			t.Errorf("Index=%d Expected=%v vs. Actual=%v (%v)", index, tc.Expected, actual, err)
+		}
+		if err != nil {
+			if !errors.Is(err, errHardlinkUnsafe) {
+				t.Errorf("Index=%d Expected=%v vs. Actual=%v", index, errHardlinkUnsafe, err)
+			}
+			continue
+		}
+		if err := hardlinkFile(source, target); err != nil {
+			t.Fatalf("Index=%d unexpected error: %v", index, err)
+		}
+		linkedInfo, err := os.Stat(target)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !os.SameFile(sourceInfo, linkedInfo) {
+			t.Errorf("Index=%d Expected the target to be a hard link to the source", index)
+		}
+	}
+	entries, err := os.ReadDir(tempDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Errorf("Expected=2 files (no temporary files left behind) vs. Actual=%d", len(entries))
+	}
+}
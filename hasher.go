@@ -0,0 +1,64 @@
+package main
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"fmt"
+	"hash"
+	"hash/crc64"
+	"strings"
+)
+
+// hasher is a hash algorithm that files can be checksummed with.
+type hasher interface {
+	// Name is the name the algorithm is selected by and recorded as.
+	Name() string
+	// New returns a new hash.Hash for the algorithm.
+	New() hash.Hash
+}
+
+var (
+	hasherSHA256 hasher = namedHasher{"sha256", sha256.New}
+	hasherSHA512 hasher = namedHasher{"sha512", sha512.New}
+	hasherSHA1   hasher = namedHasher{"sha1", sha1.New}
+	// hasherCRC64 is fast but not collision resistant, it's meant for the sample stage.
+	hasherCRC64 hasher = namedHasher{"crc64", func() hash.Hash { return crc64.New(crc64Table) }}
+)
+
+var crc64Table = crc64.MakeTable(crc64.ECMA)
+
+// hashers are the available hash algorithms.
+var hashers = []hasher{
+	hasherSHA256,
+	hasherSHA512,
+	hasherSHA1,
+	hasherCRC64,
+}
+
+// parseHasher returns the hash algorithm with a given name.
+func parseHasher(name string) (hasher, error) {
+	for _, h := range hashers {
+		if h.Name() == name {
+			return h, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown hash algorithm %q; must be one of %s", name, hasherNames())
+}
+
+// hasherNames returns the names of the available hash algorithms.
+func hasherNames() string {
+	names := make([]string, 0, len(hashers))
+	for _, h := range hashers {
+		names = append(names, h.Name())
+	}
+	return strings.Join(names, ", ")
+}
+
+type namedHasher struct {
+	name string
+	new  func() hash.Hash
+}
+
+func (nh namedHasher) Name() string   { return nh.name }
+func (nh namedHasher) New() hash.Hash { return nh.new() }
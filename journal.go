@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// defaultJournalPath returns the path of the journal in the user state directory.
+func defaultJournalPath() (string, error) {
+	stateDir, err := defaultStateDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(stateDir, "journal.jsonl"), nil
+}
+
+// defaultStateDir returns the directory of the journal and run files in the user state directory
+// (i.e. $XDG_STATE_HOME, or ~/.local/state if it's unset).
+//
+// Unlike the hash cache, these aren't something that can be regenerated,
+// so they're kept out of the cache directory.
+func defaultStateDir() (string, error) {
+	stateDir := os.Getenv("XDG_STATE_HOME")
+	if stateDir == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", err
+		}
+		stateDir = filepath.Join(home, ".local", "state")
+	}
+	return filepath.Join(stateDir, "space-saver"), nil
+}
+
+// Journal entry states; an intent is written before each replacement is attempted
+// and a completion once it has finished (whatever its outcome).
+const (
+	journalIntent = "intent"
+	journalDone   = "done"
+)
+
+// journalEntry records a replacement, as a line of JSON in the journal.
+type journalEntry struct {
+	Time time.Time `json:"time"`
+	// Run identifies the run the entry is from and Action the index of the action in its plan,
+	// so that an interrupted run can tell which of its actions were finished.
+	Run    string `json:"run,omitempty"`
+	Action int    `json:"action"`
+	State  string `json:"state,omitempty"`
+	// Outcome is the outcome of a completed replacement.
+	Outcome string `json:"outcome,omitempty"`
+	Method  string `json:"method"`
+	Source  string `json:"source"`
+	Target  string `json:"target"`
+	// Hash is the checksum both files had when the target was replaced.
+	Hash      string `json:"hash"`
+	Algorithm string `json:"algorithm"`
+	Size      int64  `json:"size"`
+}
+
+// Replaced returns if the entry records a target that was actually replaced.
+//
+// Entries without a state are from before intents were recorded, and only recorded replacements.
+func (je journalEntry) Replaced() bool {
+	return je.State == "" || (je.State == journalDone && je.Outcome == outcomeCloned.String())
+}
+
+// journal is an append only log of the replacements that were made.
+type journal struct {
+	path string
+	f    *os.File
+}
+
+// openJournal opens a journal for appending, creating it if it doesn't exist.
+//
+// If the last line is incomplete (i.e. from a write that was interrupted), it's ended
+// so that the entries we append aren't joined onto it.
+func openJournal(path string) (*journal, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, fmt.Errorf("journal: unable to create directory for %s; %w", path, err)
+	}
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("journal: unable to open %s; %w", path, err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return nil, fmt.Errorf("journal: unable to stat %s; %w", path, err)
+	}
+	if info.Size() > 0 {
+		last := make([]byte, 1)
+		if _, err := f.ReadAt(last, info.Size()-1); err != nil {
+			_ = f.Close()
+			return nil, fmt.Errorf("journal: unable to read %s; %w", path, err)
+		}
+		if last[0] != '\n' {
+			if _, err := f.Write([]byte{'\n'}); err != nil {
+				_ = f.Close()
+				return nil, fmt.Errorf("journal: unable to write to %s; %w", path, err)
+			}
+		}
+	}
+	return &journal{path: path, f: f}, nil
+}
+
+// Append writes an entry to the journal and syncs it to disk before returning.
+func (j *journal) Append(entry journalEntry) error {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	if _, err := j.f.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("journal: unable to write to %s; %w", j.path, err)
+	}
+	if err := j.f.Sync(); err != nil {
+		return fmt.Errorf("journal: unable to sync %s; %w", j.path, err)
+	}
+	return nil
+}
+
+// Intend appends an intent entry for an action of a run, before it's attempted.
+func (j *journal) Intend(run string, index int, method, algorithm string, action planAction) error {
+	return j.Append(newJournalEntry(run, index, journalIntent, method, algorithm, action))
+}
+
+// Complete appends a completion entry for an action of a run, with its outcome.
+func (j *journal) Complete(run string, index int, algorithm string, action planAction, result actionResult) error {
+	entry := newJournalEntry(run, index, journalDone, result.Method, algorithm, action)
+	entry.Outcome = result.Outcome.String()
+	return j.Append(entry)
+}
+
+func newJournalEntry(run string, index int, state, method, algorithm string, action planAction) journalEntry {
+	return journalEntry{
+		Time:      time.Now().UTC(),
+		Run:       run,
+		Action:    index,
+		State:     state,
+		Method:    method,
+		Source:    action.Source.Path,
+		Target:    action.Target.Path,
+		Hash:      action.Hash,
+		Algorithm: algorithm,
+		Size:      action.Target.Size,
+	}
+}
+
+// Close closes the journal.
+func (j *journal) Close() error {
+	return j.f.Close()
+}
+
+// readJournal reads the entries of a journal in the order they were written.
+//
+// Lines that can't be parsed (i.e. from a write that was interrupted) are skipped.
+func readJournal(path string) (entries []journalEntry, err error) {
+	var f *os.File
+	f, err = os.Open(path)
+	if err != nil {
+		err = fmt.Errorf("journal: unable to read %s; %w", path, err)
+		return
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var entry journalEntry
+		if json.Unmarshal(scanner.Bytes(), &entry) != nil {
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	if err = scanner.Err(); err != nil {
+		err = fmt.Errorf("journal: unable to read %s; %w", path, err)
+	}
+	return
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func Test_journal(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state", "journal.jsonl")
+	expected := []journalEntry{
+		{Time: time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC), Method: methodClone, Source: "/a", Target: "/b", Hash: "abc", Algorithm: "sha256", Size: 11},
+		{Time: time.Date(2024, 1, 2, 3, 4, 6, 0, time.UTC), Method: methodHardlink, Source: "/a", Target: "/c", Hash: "abc", Algorithm: "sha256", Size: 11},
+	}
+	for _, entry := range expected {
+		j, err := openJournal(path)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if err := j.Append(entry); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if err := j.Close(); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	// a line from an interrupted write is ignored.
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteString(`{"time":"2024-01-02T03:`); err != nil {
+		t.Fatal(err)
+	}
+	_ = f.Close()
+
+	actual, err := readJournal(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(actual) != len(expected) {
+		t.Fatalf("Expected=%d entries vs. Actual=%d", len(expected), len(actual))
+	}
+
+	// entries appended after an interrupted write aren't joined onto it.
+	expected = append(expected, journalEntry{Time: time.Date(2024, 1, 2, 3, 4, 7, 0, time.UTC), Run: "run", Action: 1, State: journalIntent, Method: methodClone, Source: "/a", Target: "/d"})
+	j, err := openJournal(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := j.Append(expected[len(expected)-1]); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	_ = j.Close()
+	actual, err = readJournal(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(actual) != len(expected) {
+		t.Fatalf("Expected=%d entries vs. Actual=%d", len(expected), len(actual))
+	}
+	for index := range expected {
+		if actual[index] != expected[index] {
+			t.Errorf("Index=%d Expected=%v vs. Actual=%v", index, expected[index], actual[index])
+		}
+	}
+}
+
+func Test_undoEntry(t *testing.T) {
+	tempDir := t.TempDir()
+	source, target := filepath.Join(tempDir, "source"), filepath.Join(tempDir, "target")
+	if err := os.WriteFile(source, []byte("hello world"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Link(source, target); err != nil {
+		t.Fatal(err)
+	}
+	entry := journalEntry{Method: methodHardlink, Source: source, Target: target, Size: 11}
+
+	testCases := [...]struct {
+		Real     bool
+		Expected undoOutcome
+	}{
+		{false, undoUnshared},
+		{true, undoUnshared},
+	}
+	for index, tc := range testCases {
+		result := undoEntry(t.Context(), entry, tc.Real)
+		if result.Outcome != tc.Expected {
+			t.Errorf("Index=%d Expected=%v vs. Actual=%v (%v)", index, tc.Expected, result.Outcome, result.Err)
+		}
+	}
+	sourceInfo, err := os.Stat(source)
+	if err != nil {
+		t.Fatal(err)
+	}
+	targetInfo, err := os.Stat(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if os.SameFile(sourceInfo, targetInfo) {
+		t.Errorf("Expected the target to be an independent copy")
+	}
+	contents, err := os.ReadFile(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(contents) != "hello world" {
+		t.Errorf("Expected=hello world vs. Actual=%s", contents)
+	}
+	// once it's independent it's left alone, if we can tell that it is.
+	if _, err := fileSharing(fullFileInfo{Path: source, FileInfo: sourceInfo}, fullFileInfo{Path: target, FileInfo: targetInfo}); err == nil {
+		if result := undoEntry(t.Context(), entry, true); result.Outcome != undoAlreadyIndependent {
+			t.Errorf("Expected=%v vs. Actual=%v (%v)", undoAlreadyIndependent, result.Outcome, result.Err)
+		}
+	}
+
+	if result := undoEntry(t.Context(), journalEntry{Target: filepath.Join(tempDir, "missing")}, true); result.Outcome != undoMissing {
+		t.Errorf("Expected=%v vs. Actual=%v", undoMissing, result.Outcome)
+	}
+}
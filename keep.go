@@ -0,0 +1,117 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// keepPolicy decides which file in a group of duplicates is kept as the source
+// that the others are replaced with clones of.
+type keepPolicy int
+
+const (
+	keepOldest keepPolicy = iota
+	keepNewest
+	keepShortestPath
+	keepLongestPath
+	keepFirstRoot
+	keepMostLinks
+	keepPolicyCount // must be last
+)
+
+func (kp keepPolicy) String() string {
+	switch kp {
+	case keepOldest:
+		return "oldest"
+	case keepNewest:
+		return "newest"
+	case keepShortestPath:
+		return "shortest-path"
+	case keepLongestPath:
+		return "longest-path"
+	case keepFirstRoot:
+		return "first-root"
+	case keepMostLinks:
+		return "most-links"
+	default:
+		return fmt.Sprintf("unknown(%d)", int(kp))
+	}
+}
+
+// parseKeepPolicy returns the keep policy with a given name.
+func parseKeepPolicy(name string) (keepPolicy, error) {
+	for kp := range keepPolicyCount {
+		if kp.String() == name {
+			return kp, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown keep policy %q; must be one of %s", name, keepPolicyNames())
+}
+
+// keepPolicyNames returns the names of the keep policies.
+func keepPolicyNames() string {
+	names := make([]string, 0, keepPolicyCount)
+	for kp := range keepPolicyCount {
+		names = append(names, kp.String())
+	}
+	return strings.Join(names, ", ")
+}
+
+// sourceSelector orders the files of a group so that the file to keep is first.
+type sourceSelector struct {
+	Policy keepPolicy
+	// Prefer are absolute directories whose files are kept over any others, in order of preference.
+	Prefer []string
+}
+
+// Compare orders two files by preference, then by policy, then by modification time and path,
+// so that the order is the same from run to run.
+func (ss sourceSelector) Compare(a, b fullFileInfo) int {
+	if c := cmp.Compare(ss.preferred(a), ss.preferred(b)); c != 0 {
+		return c
+	}
+	var c int
+	switch ss.Policy {
+	case keepOldest:
+		c = compareModTime(a, b)
+	case keepNewest:
+		c = compareModTime(b, a)
+	case keepShortestPath:
+		c = cmp.Compare(len(a.Path), len(b.Path))
+	case keepLongestPath:
+		c = cmp.Compare(len(b.Path), len(a.Path))
+	case keepFirstRoot:
+		c = cmp.Compare(a.Root, b.Root)
+	case keepMostLinks:
+		aStat, _ := statOf(a.FileInfo)
+		bStat, _ := statOf(b.FileInfo)
+		c = cmp.Compare(bStat.Nlink, aStat.Nlink)
+	}
+	if c != 0 {
+		return c
+	}
+	if c := compareModTime(a, b); c != 0 {
+		return c
+	}
+	return strings.Compare(a.Path, b.Path)
+}
+
+// preferred returns the index of the first preferred directory a file is within,
+// or the number of preferred directories if it's in none of them.
+func (ss sourceSelector) preferred(ffi fullFileInfo) int {
+	if len(ss.Prefer) == 0 {
+		return 0
+	}
+	abs, err := filepath.Abs(ffi.Path)
+	if err != nil {
+		return len(ss.Prefer)
+	}
+	for index, dir := range ss.Prefer {
+		if abs == dir || isWithin(abs, dir) {
+			return index
+		}
+	}
+	return len(ss.Prefer)
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+func Test_sourceSelector(t *testing.T) {
+	tempDir := t.TempDir()
+	now := time.Now()
+	files := []struct {
+		Name    string
+		Root    int
+		ModTime time.Time
+	}{
+		{"b/older", 1, now.Add(-2 * time.Hour)},
+		{"a/deeper/newer", 0, now},
+		{"a/same-time", 0, now.Add(-time.Hour)},
+		{"b/same-time", 1, now.Add(-time.Hour)},
+	}
+	var group []fullFileInfo
+	for _, f := range files {
+		path := filepath.Join(tempDir, f.Name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte("hello world"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(path, f.ModTime, f.ModTime); err != nil {
+			t.Fatal(err)
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		group = append(group, fullFileInfo{FileInfo: info, Path: path, Root: f.Root})
+	}
+	// a hard link to "a/same-time" gives it the most links.
+	if err := os.Link(group[2].Path, filepath.Join(tempDir, "a", "link")); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(group[2].Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	group[2].FileInfo = info
+
+	testCases := [...]struct {
+		Policy   keepPolicy
+		Prefer   []string
+		Expected []string
+	}{
+		{keepOldest, nil, []string{"b/older", "a/same-time", "b/same-time", "a/deeper/newer"}},
+		{keepNewest, nil, []string{"a/deeper/newer", "a/same-time", "b/same-time", "b/older"}},
+		{keepShortestPath, nil, []string{"b/older", "a/same-time", "b/same-time", "a/deeper/newer"}},
+		{keepLongestPath, nil, []string{"a/deeper/newer", "a/same-time", "b/same-time", "b/older"}},
+		{keepFirstRoot, nil, []string{"a/same-time", "a/deeper/newer", "b/older", "b/same-time"}},
+		{keepMostLinks, nil, []string{"a/same-time", "b/older", "b/same-time", "a/deeper/newer"}},
+		{keepOldest, []string{filepath.Join(tempDir, "a", "deeper")}, []string{"a/deeper/newer", "b/older", "a/same-time", "b/same-time"}},
+		{keepNewest, []string{filepath.Join(tempDir, "b"), filepath.Join(tempDir, "a")}, []string{"b/same-time", "b/older", "a/deeper/newer", "a/same-time"}},
+	}
+
+	for _, tc := range testCases {
+		sorted := slices.Clone(group)
+		slices.SortFunc(sorted, sourceSelector{Policy: tc.Policy, Prefer: tc.Prefer}.Compare)
+		var actual []string
+		for _, ffi := range sorted {
+			rel, _ := filepath.Rel(tempDir, ffi.Path)
+			actual = append(actual, filepath.ToSlash(rel))
+		}
+		if !slices.Equal(tc.Expected, actual) {
+			t.Errorf("Input=%v %v Expected=%v vs. Actual=%v", tc.Policy, tc.Prefer, tc.Expected, actual)
+		}
+	}
+}
+
+func Test_parseKeepPolicy(t *testing.T) {
+	for kp := range keepPolicyCount {
+		actual, err := parseKeepPolicy(kp.String())
+		if err != nil {
+			t.Errorf("Input=%v unexpected error: %v", kp, err)
+		}
+		if actual != kp {
+			t.Errorf("Input=%v Expected=%v vs. Actual=%v", kp.String(), kp, actual)
+		}
+	}
+	if _, err := parseKeepPolicy("nope"); err == nil {
+		t.Errorf("Input=nope Expected an error")
+	}
+}
@@ -2,26 +2,34 @@ package main
 
 import (
 	"context"
-	"crypto/sha256"
-	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
 	"io/fs"
 	"os"
-	"path/filepath"
+	"os/signal"
+	"runtime"
 	"slices"
+	"strings"
+	"syscall"
 
 	"github.com/urfave/cli/v3"
 	"github.com/wcharczuk/space-saver/pkg/filesize"
-	"golang.org/x/sys/unix"
 )
 
 func main() {
-	if err := commandRoot.Run(context.Background(), os.Args); err != nil {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	go func() {
+		// once we've been interrupted, let a second signal kill us outright.
+		<-ctx.Done()
+		stop()
+	}()
+	if err := commandRoot.Run(ctx, os.Args); err != nil {
+		stop()
 		fmt.Fprintf(os.Stderr, "%v\n", err)
 		os.Exit(1)
 	}
+	stop()
 }
 
 var commandRoot = &cli.Command{
@@ -30,8 +38,10 @@ var commandRoot = &cli.Command{
 	Commands: []*cli.Command{
 		commandFindDuplicates,
 		commandCloneDuplicates,
+		commandUndo,
 		commandCloneFile,
 		commandSameFile,
+		commandCache,
 	},
 	Action: func(ctx context.Context, cmd *cli.Command) error {
 		cli.ShowAppHelp(cmd)
@@ -41,101 +51,674 @@ var commandRoot = &cli.Command{
 
 var commandFindDuplicates = &cli.Command{
 	Name:      "find",
-	Usage:     "Find duplicate files by comparing sha256 hashes.",
-	ArgsUsage: "[TARGET_DIR]",
-	Flags: []cli.Flag{
+	Usage:     "Find duplicate files by comparing hashes (sha256 by default).",
+	ArgsUsage: "[TARGET_DIR...]",
+	Flags: append([]cli.Flag{
+		&cli.BoolFlag{
+			Name:  "keep-going",
+			Usage: "If we should skip paths that can't be read or hashed (and report them) rather than stopping",
+			Value: true,
+		},
+		strictFlag,
 		&cli.StringFlag{
-			Name:  "min-size",
-			Value: "5MiB",
-			Usage: "The minimum filesize (in kubernetes size format, e.g. 4500MiB)",
+			Name:  "output",
+			Value: outputText,
+			Usage: "The output format; one of " + strings.Join(outputFormats, ", ") + " (for anything but text, everything other than the duplicates is written to stderr)",
 		},
-	},
+		&cli.StringFlag{
+			Name:  "sort",
+			Value: sortSavings,
+			Usage: "The order of the duplicates; one of " + strings.Join(sortOrders, ", "),
+		},
+		&cli.IntFlag{
+			Name:  "top",
+			Usage: "The number of sets of duplicates to show, in --sort order (0 shows them all)",
+		},
+		&cli.StringFlag{
+			Name:  "plan-out",
+			Usage: "A path to write the actions clone-duplicates would take on the sets of duplicates shown (see --top) to, to be reviewed and then applied with clone-duplicates --plan",
+		},
+	}, scanFlags...),
 	Action: func(ctx context.Context, c *cli.Command) error {
 		if !c.Args().Present() {
-			return fmt.Errorf("Must provide a TARGET_DIR")
+			return fmt.Errorf("Must provide at least one TARGET_DIR")
+		}
+		output := c.String("output")
+		if !slices.Contains(outputFormats, output) {
+			return fmt.Errorf("Invalid --output: %q", output)
 		}
-		if len(c.Args().Slice()) > 1 {
-			return fmt.Errorf("Must only provide a TARGET_DIR")
+		order := c.String("sort")
+		if !slices.Contains(sortOrders, order) {
+			return fmt.Errorf("Invalid --sort: %q", order)
 		}
-		minSizeBytes, err := filesize.Parse(c.String("min-size"))
+		top := int(c.Int("top"))
+		if top < 0 {
+			return fmt.Errorf("Invalid --top: %d", top)
+		}
+		// in the machine readable formats stdout is just the data.
+		info := io.Writer(os.Stdout)
+		if output != outputText {
+			info = os.Stderr
+		}
+		opts, err := scanOptionsFromFlags(c, info)
 		if err != nil {
 			return err
 		}
-		fmt.Fprintf(os.Stdout, "Using min size bytes: %v\n", c.String("min-size"))
-		targetDir := c.Args().First()
-		hashes, err := findDuplicateFiles(targetDir, minSizeBytes)
+		fmt.Fprintf(info, "Using min size bytes: %v\n", c.String("min-size"))
+		result, err := findDuplicateFiles(ctx, c.Args().Slice(), opts)
 		if err != nil {
 			return err
 		}
-		var totalPossibleSavingsBytes uint64
-		for _, fileset := range hashes {
-			if len(fileset) < 2 {
-				continue
+		printHashCacheStats(info, opts.Cache)
+		var totalPossibleSavingsBytes, alreadySharedBytes uint64
+		for _, group := range result.Groups {
+			for index, fileInfo := range group.Files[1:] {
+				sharing := group.Sharing[index+1]
+				totalPossibleSavingsBytes += sharing.Reclaimable()
+				alreadySharedBytes += uint64(fileInfo.Size()) - sharing.Reclaimable()
+			}
+		}
+		if err := sortGroups(result.Groups, order); err != nil {
+			return err
+		}
+		groupCount := len(result.Groups)
+		if top > 0 && top < groupCount {
+			result.Groups = result.Groups[:top]
+		}
+		// the plan is of the groups that are shown, so that what's applied is what was reviewed.
+		if planPath := c.String("plan-out"); planPath != "" {
+			p, err := newPlan(result)
+			if err != nil {
+				return err
 			}
-			srcFile := fileset[0]
-			for _, fileInfo := range fileset[1:] {
-				totalPossibleSavingsBytes += uint64(fileInfo.Size())
-				fmt.Fprintf(os.Stdout, "%s is a duplicate of %s (%s)\n", truncateStringPrefix(fileInfo.Path, 32), truncateStringPrefix(srcFile.Path, 32), filesize.Format(uint64(fileInfo.Size())))
+			if err := writePlan(planPath, p); err != nil {
+				return err
 			}
+			fmt.Fprintf(info, "Wrote %d actions to plan %s\n", len(p.Actions), planPath)
 		}
+		if output != outputText {
+			gw, err := newGroupWriter(output, os.Stdout)
+			if err != nil {
+				return err
+			}
+			records, err := groupRecords(result)
+			if err != nil {
+				return err
+			}
+			for _, record := range records {
+				if err := gw.Write(record); err != nil {
+					return err
+				}
+			}
+			if err := gw.Close(); err != nil {
+				return err
+			}
+			printSpecialCounts(info, result.Special)
+			printScanErrors(info, result.Errors)
+			return strictError(c, result.Errors)
+		}
+		printGroupReport(os.Stdout, result.Algorithm, result.Groups)
+		if len(result.Groups) < groupCount {
+			fmt.Fprintf(os.Stdout, "Showing %d of %d sets of duplicates\n", len(result.Groups), groupCount)
+		}
+		printCrossDeviceDuplicates(os.Stdout, result.CrossDevice)
+		printSpecialCounts(os.Stdout, result.Special)
+		printScanErrors(os.Stdout, result.Errors)
+		fmt.Fprintf(os.Stdout, "Already shared: %s\n", filesize.FormatFraction(alreadySharedBytes))
 		fmt.Fprintf(os.Stdout, "Total savings: %s\n", filesize.FormatFraction(totalPossibleSavingsBytes))
-		return nil
+		return strictError(c, result.Errors)
 	},
 }
 
 var commandCloneDuplicates = &cli.Command{
 	Name:      "clone-duplicates",
-	Usage:     "Clone duplicate files by comparing sha256 hashes and replacing them with cloned files.",
-	ArgsUsage: "[TARGET_DIR]",
-	Flags: []cli.Flag{
-		&cli.StringFlag{
-			Name:  "min-size",
-			Usage: "The minimum filesize (in kubernetes size format, e.g. 4500MiB)",
-			Value: "5MiB",
-		},
+	Usage:     "Clone duplicate files by comparing hashes (sha256 by default) and replacing them with cloned files.",
+	ArgsUsage: "[TARGET_DIR...]",
+	Flags: append([]cli.Flag{
 		&cli.BoolFlag{
 			Name:  "real",
 			Usage: "If we should proceed with replacing duplicate files with cloned files",
 			Value: false,
 		},
-	},
+		&cli.StringFlag{
+			Name:  "method",
+			Usage: "How duplicates are replaced; one of clone (replace the target with a clone of the source), dedupe (linux only, kernel verified extent sharing that leaves the target inode in place) or hardlink (replace the target with a hard link to the source, for filesystems without clones)",
+			Value: methodClone,
+		},
+		journalFlag,
+		&cli.BoolFlag{
+			Name:  "fresh",
+			Usage: "If we should discard the progress of an interrupted --real run of the same targets (or plan) and start over, rather than resuming it",
+		},
+		&cli.StringFlag{
+			Name:  "plan",
+			Usage: "A plan written by find --plan-out to apply instead of scanning; actions whose files have changed since are refused",
+		},
+		&cli.BoolFlag{
+			Name:  "hardlink-read-only",
+			Usage: "If we should only replace files that aren't writable with hard links (for --method=hardlink)",
+		},
+		&cli.BoolFlag{
+			Name:  "keep-going",
+			Usage: "If we should skip paths that can't be read or hashed (and report them) rather than stopping",
+			Value: false,
+		},
+		strictFlag,
+		&cli.BoolFlag{
+			Name:  "verify",
+			Usage: "If we should compare each duplicate byte for byte with its source immediately before replacing it (not needed for --method=dedupe, where the kernel compares them)",
+			Value: true,
+		},
+	}, scanFlags...),
 	Action: func(ctx context.Context, c *cli.Command) error {
-		if !c.Args().Present() {
-			return fmt.Errorf("Must provide a TARGET_DIR")
+		planPath := c.String("plan")
+		if planPath == "" && !c.Args().Present() {
+			return fmt.Errorf("Must provide at least one TARGET_DIR or a --plan")
+		}
+		if planPath != "" && c.Args().Present() {
+			return fmt.Errorf("Must provide either TARGET_DIRs or a --plan, not both")
+		}
+		method := c.String("method")
+		switch method {
+		case methodClone:
+		case methodDedupe:
+			if !dedupeSupported {
+				return fmt.Errorf("--method=%s is only supported on linux", methodDedupe)
+			}
+		case methodHardlink:
+			fmt.Fprintln(os.Stdout, "Warning: hard linked duplicates are the same file, writing to any one of them changes all of them")
+		default:
+			return fmt.Errorf("Invalid --method: %q", method)
+		}
+		replaceOpts := replaceOptions{
+			Method:   method,
+			Verify:   c.Bool("verify"),
+			ReadOnly: c.Bool("hardlink-read-only"),
+		}
+		real := c.Bool("real")
+
+		var runPath string
+		if real {
+			inputs := c.Args().Slice()
+			if planPath != "" {
+				inputs = []string{planPath}
+			}
+			var err error
+			runPath, err = defaultRunPath(inputs)
+			if err != nil {
+				return fmt.Errorf("unable to determine run path; %w", err)
+			}
+			fresh := c.Bool("fresh")
+			rs, err := openRunState(runPath)
+			if err != nil {
+				if !fresh {
+					return err
+				}
+				// the run file is overwritten by the fresh run.
+				fmt.Fprintf(os.Stdout, "Discarding interrupted run %s; %v\n", runPath, err)
+			}
+			if rs != nil && fresh {
+				if err := discardRun(c, rs); err != nil {
+					return err
+				}
+			}
+			if rs != nil && !fresh {
+				fmt.Fprintf(os.Stdout, "Resuming interrupted run %s with %d actions (use --fresh to start over)\n", runPath, len(rs.Plan.Actions))
+				checker, done, err := planCheckerFromFlags(c, rs.Plan.Algorithm)
+				if err != nil {
+					return err
+				}
+				defer done()
+				return applyPlan(ctx, c, rs.Plan, rs, checker, replaceOpts)
+			}
 		}
-		if len(c.Args().Slice()) > 1 {
-			return fmt.Errorf("Must only provide a TARGET_DIR")
+
+		if planPath != "" {
+			p, err := readPlan(planPath)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(os.Stdout, "Using plan %s with %d actions\n", planPath, len(p.Actions))
+			checker, done, err := planCheckerFromFlags(c, p.Algorithm)
+			if err != nil {
+				return err
+			}
+			defer done()
+			var rs *runState
+			if real {
+				if rs, err = newRunState(runPath, p); err != nil {
+					return err
+				}
+			}
+			return applyPlan(ctx, c, p, rs, checker, replaceOpts)
 		}
-		minSizeBytes, err := filesize.Parse(c.String("min-size"))
+
+		opts, err := scanOptionsFromFlags(c, os.Stdout)
 		if err != nil {
 			return err
 		}
 		fmt.Fprintf(os.Stdout, "Using min size bytes: %v\n", c.String("min-size"))
-		targetDir := c.Args().First()
-		hashes, err := findDuplicateFiles(targetDir, minSizeBytes)
+		scan, err := findDuplicateFiles(ctx, c.Args().Slice(), opts)
 		if err != nil {
 			return err
 		}
-		var totalPossibleSavingsBytes uint64
-		real := c.Bool("real")
-		for _, fileset := range hashes {
-			if len(fileset) < 2 {
-				continue
-			}
-			srcFile := fileset[0]
-			for _, fileInfo := range fileset[1:] {
-				totalPossibleSavingsBytes += uint64(fileInfo.Size())
-				if real {
-					if err := cloneFile(srcFile.Path, fileInfo.Path); err != nil {
-						return err
+		printHashCacheStats(os.Stdout, opts.Cache)
+		printCrossDeviceDuplicates(os.Stdout, scan.CrossDevice)
+		printSpecialCounts(os.Stdout, scan.Special)
+		printScanErrors(os.Stdout, scan.Errors)
+		if !real {
+			var totalPossibleSavingsBytes uint64
+			for _, group := range scan.Groups {
+				srcFile := group.Files[0]
+				for index, fileInfo := range group.Files[1:] {
+					if group.Sharing[index+1].Kind() == sharingFull {
+						fmt.Fprintf(os.Stdout, "[DRY-RUN] Would skip %s, already shared with %s\n", truncateStringPrefix(fileInfo.Path, 64), truncateStringPrefix(srcFile.Path, 64))
+						continue
 					}
-					fmt.Fprintf(os.Stdout, "Cloned %s to %s\n", truncateStringPrefix(srcFile.Path, 64), truncateStringPrefix(fileInfo.Path, 64))
-				} else {
-					fmt.Fprintf(os.Stdout, "[DRY-RUN] Would clone %s to %s\n", truncateStringPrefix(srcFile.Path, 64), truncateStringPrefix(fileInfo.Path, 64))
+					totalPossibleSavingsBytes += group.Sharing[index+1].Reclaimable()
+					fmt.Fprintf(os.Stdout, "[DRY-RUN] Would %s %s to %s\n", method, truncateStringPrefix(srcFile.Path, 64), truncateStringPrefix(fileInfo.Path, 64))
 				}
 			}
+			fmt.Fprintf(os.Stdout, "Total possible savings: %s\n", filesize.FormatFraction(totalPossibleSavingsBytes))
+			return strictError(c, scan.Errors)
+		}
+		p, err := newPlan(scan)
+		if err != nil {
+			return err
+		}
+		// the files were just hashed, so they only need to be checked against what was hashed.
+		checker := newPlanChecker(opts.Hasher, nil)
+		checker.Seed(scan)
+		rs, err := newRunState(runPath, p)
+		if err != nil {
+			return err
+		}
+		if err := applyPlan(ctx, c, p, rs, checker, replaceOpts); err != nil {
+			return err
+		}
+		return strictError(c, scan.Errors)
+	},
+}
+
+// planCheckerFromFlags returns a plan checker for an algorithm that uses the hash cache (unless --no-cache),
+// along with a function that saves the cache once the checker is finished with.
+func planCheckerFromFlags(c *cli.Command, algorithm string) (*planChecker, func(), error) {
+	hasher, err := parseHasher(algorithm)
+	if err != nil {
+		return nil, nil, err
+	}
+	if c.Bool("no-cache") {
+		return newPlanChecker(hasher, nil), func() {}, nil
+	}
+	cache, err := openHashCacheFromFlags(c)
+	if err != nil {
+		return nil, nil, err
+	}
+	return newPlanChecker(hasher, cache), func() {
+		if err := cache.Save(); err != nil {
+			fmt.Fprintf(os.Stderr, "unable to save hash cache; %v\n", err)
+		}
+	}, nil
+}
+
+// discardRun removes the temporary files left by the unfinished actions of an interrupted run
+// that's being started over with --fresh, so that they aren't mistaken for duplicates.
+func discardRun(c *cli.Command, rs *runState) error {
+	journalPath, err := journalPathFromFlags(c)
+	if err != nil {
+		return err
+	}
+	entries, err := readJournal(journalPath)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	rs.Progress(entries)
+	removed, err := rs.RemoveTemp()
+	for _, path := range removed {
+		fmt.Fprintf(os.Stdout, "Removed %s left by an unfinished replacement\n", path)
+	}
+	return err
+}
+
+// applyPlan takes the actions of a plan (or in a dry run, checks and prints them),
+// refusing any whose files have changed since the plan was made.
+//
+// A real run has a run state, which is saved before any action is taken and removed once they all have been.
+// Each action is recorded in the journal with an intent entry before it's taken and a completion entry after,
+// so that if the run is interrupted it can be resumed: the actions that were started but not finished
+// are repaired and taken again, and those that were finished are skipped.
+func applyPlan(ctx context.Context, c *cli.Command, p plan, rs *runState, checker *planChecker, replaceOpts replaceOptions) error {
+	real := rs != nil
+	var j *journal
+	if real {
+		journalPath, err := journalPathFromFlags(c)
+		if err != nil {
+			return err
+		}
+		var finished map[int]actionResult
+		if rs.Resumed {
+			entries, err := readJournal(journalPath)
+			if err != nil && !errors.Is(err, fs.ErrNotExist) {
+				return err
+			}
+			rs.Progress(entries)
+			var removed []string
+			removed, finished, err = rs.Repair()
+			for _, path := range removed {
+				fmt.Fprintf(os.Stdout, "Removed %s left by an unfinished replacement\n", path)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		if err := rs.Save(); err != nil {
+			return err
+		}
+		j, err = openJournal(journalPath)
+		if err != nil {
+			return err
+		}
+		defer j.Close()
+		for index, action := range p.Actions {
+			result, ok := finished[index]
+			if !ok {
+				continue
+			}
+			fmt.Fprintf(os.Stdout, "Found %s was replaced by an unfinished run\n", truncateStringPrefix(action.Target.Path, 64))
+			if err := j.Complete(rs.ID, index, p.Algorithm, action, result); err != nil {
+				return err
+			}
+		}
+	}
+	var summary outcomeSummary
+actions:
+	for index, action := range p.Actions {
+		if err := ctx.Err(); err != nil {
+			break
+		}
+		if real && rs.Done(index) {
+			continue
+		}
+		result := actionResult{Method: replaceOpts.Method}
+		var err error
+		result.Source, err = checker.Check(ctx, action.Hash, action.Source)
+		if err == nil {
+			result.Target, err = checker.Check(ctx, action.Hash, action.Target)
+		}
+		switch {
+		case err != nil:
+			if result.Target.FileInfo == nil {
+				result.Target = fullFileInfo{Path: action.Target.Path, FileInfo: plannedFileInfo{action.Target}}
+			}
+			if result.Source.FileInfo == nil {
+				result.Source = fullFileInfo{Path: action.Source.Path, FileInfo: plannedFileInfo{action.Source}}
+			}
+			result.Outcome, result.Err = outcomeChangedSinceHash, err
+			if !errors.Is(err, errPlanPrecondition) {
+				result.Outcome = outcomeFailed
+			}
+		case !real:
+			fmt.Fprintf(os.Stdout, "[DRY-RUN] Would %s %s to %s\n", replaceOpts.Method, truncateStringPrefix(action.Source.Path, 64), truncateStringPrefix(action.Target.Path, 64))
+			continue
+		default:
+			if err := j.Intend(rs.ID, index, replaceOpts.Method, p.Algorithm, action); err != nil {
+				return err
+			}
+			result = replaceDuplicate(ctx, replaceOpts, result.Source, result.Target)
+			if result.Outcome == outcomeFailed && ctx.Err() != nil {
+				// interrupted part way through, so it's left unfinished to be repaired on resume.
+				printActionResult(os.Stdout, result)
+				break actions
+			}
+		}
+		if real {
+			if err := j.Complete(rs.ID, index, p.Algorithm, action, result); err != nil {
+				return err
+			}
+		}
+		summary.Add(result)
+		printActionResult(os.Stdout, result)
+	}
+	if !real {
+		if refused := summary.Counts[outcomeChangedSinceHash] + summary.Counts[outcomeFailed]; refused > 0 {
+			fmt.Fprintf(os.Stdout, "[DRY-RUN] %d actions would be refused\n", refused)
+		}
+		return nil
+	}
+	summary.Print(os.Stdout)
+	if err := ctx.Err(); err != nil {
+		return fmt.Errorf("clone-duplicates interrupted; %w; run it again to resume", err)
+	}
+	if err := rs.Remove(); err != nil {
+		return err
+	}
+	if failed := summary.Counts[outcomeFailed]; failed > 0 {
+		return fmt.Errorf("%d actions failed", failed)
+	}
+	return nil
+}
+
+// scanFlags are the flags shared by the commands that search for duplicates.
+var scanFlags = []cli.Flag{
+	&cli.StringFlag{
+		Name:  "min-size",
+		Value: "5MiB",
+		Usage: "The minimum filesize (in kubernetes size format, e.g. 4500MiB)",
+	},
+	&cli.IntFlag{
+		Name:  "jobs",
+		Value: int64(runtime.NumCPU()),
+		Usage: "The number of files to hash concurrently",
+	},
+	&cli.StringFlag{
+		Name:  "hash",
+		Value: hasherSHA256.Name(),
+		Usage: "The hash algorithm used to compare the full contents of files; one of " + hasherNames(),
+	},
+	&cli.StringFlag{
+		Name:  "sample-hash",
+		Value: hasherCRC64.Name(),
+		Usage: "The hash algorithm used to compare samples of files before hashing their full contents; one of " + hasherNames(),
+	},
+	&cli.StringFlag{
+		Name:  "keep",
+		Value: keepOldest.String(),
+		Usage: "Which file of a set of duplicates is kept as the source of the others; one of " + keepPolicyNames(),
+	},
+	&cli.StringSliceFlag{
+		Name:  "prefer",
+		Usage: "A directory whose files are kept over any others regardless of --keep; can be repeated, in order of preference",
+	},
+	&cli.BoolFlag{
+		Name:  "follow-symlinks",
+		Usage: "If we should walk into symlinked directories and consider symlinked files (by the path they resolve to)",
+	},
+	&cli.BoolFlag{
+		Name:  "one-file-system",
+		Usage: "If we should skip directories on different filesystems than the TARGET_DIR they're found under",
+	},
+	&cli.StringSliceFlag{
+		Name:  "include",
+		Usage: "Only consider files matching a gitignore style pattern (can be repeated)",
+	},
+	&cli.StringSliceFlag{
+		Name:  "exclude",
+		Usage: "Skip files and directories matching a gitignore style pattern (can be repeated); " + ignoreFileName + " files are also honored per directory",
+	},
+	cacheFlag,
+	&cli.BoolFlag{
+		Name:  "no-cache",
+		Usage: "If we should skip reading and writing the hash cache",
+	},
+	&cli.StringFlag{
+		Name:  "checkpoint",
+		Usage: "The path to save a checkpoint of completed hashes to if the scan is interrupted (defaults to a file in the user cache directory)",
+	},
+	&cli.BoolFlag{
+		Name:  "resume",
+		Usage: "If we should resume from the checkpoint of a previously interrupted scan",
+	},
+}
+
+var strictFlag = &cli.BoolFlag{
+	Name:  "strict",
+	Usage: "If we should exit with an error if any paths were skipped because of errors",
+}
+
+var journalFlag = &cli.StringFlag{
+	Name:  "journal",
+	Usage: "The path of the journal that replacements are recorded in (defaults to a file in the user state directory)",
+}
+
+var cacheFlag = &cli.StringFlag{
+	Name:  "cache",
+	Usage: "The path to the hash cache (defaults to a file in the user cache directory)",
+}
+
+// scanOptionsFromFlags returns the options of a scan from its flags, writing what it's resuming from (if anything) to info.
+func scanOptionsFromFlags(c *cli.Command, info io.Writer) (opts scanOptions, err error) {
+	opts.MinSizeBytes, err = filesize.Parse(c.String("min-size"))
+	if err != nil {
+		return
+	}
+	opts.Jobs = int(c.Int("jobs"))
+	if opts.Jobs < 1 {
+		err = fmt.Errorf("Invalid --jobs: %d", opts.Jobs)
+		return
+	}
+	opts.Hasher, err = parseHasher(c.String("hash"))
+	if err != nil {
+		return
+	}
+	opts.SampleHasher, err = parseHasher(c.String("sample-hash"))
+	if err != nil {
+		return
+	}
+	opts.Keep, err = parseKeepPolicy(c.String("keep"))
+	if err != nil {
+		return
+	}
+	opts.Prefer = c.StringSlice("prefer")
+	opts.KeepGoing = c.Bool("keep-going")
+	opts.FollowSymlinks = c.Bool("follow-symlinks")
+	opts.OneFileSystem = c.Bool("one-file-system")
+	opts.Include = c.StringSlice("include")
+	opts.Exclude = c.StringSlice("exclude")
+	if !c.Bool("no-cache") {
+		opts.Cache, err = openHashCacheFromFlags(c)
+		if err != nil {
+			return
+		}
+	}
+	checkpointPath := c.String("checkpoint")
+	if checkpointPath == "" {
+		checkpointPath, err = defaultCheckpointPath(c.Args().Slice())
+		if err != nil {
+			err = fmt.Errorf("unable to determine checkpoint path, use --checkpoint; %w", err)
+			return
+		}
+	}
+	if c.Bool("resume") {
+		opts.Checkpoint, err = openHashCache(checkpointPath)
+		if err != nil {
+			return
+		}
+		fmt.Fprintf(info, "Resuming with %d checksums from %s\n", opts.Checkpoint.Len(), checkpointPath)
+	} else {
+		opts.Checkpoint = newHashCache(checkpointPath)
+	}
+	return
+}
+
+func openHashCacheFromFlags(c *cli.Command) (*hashCache, error) {
+	path, err := hashCachePathFromFlags(c)
+	if err != nil {
+		return nil, err
+	}
+	return openHashCache(path)
+}
+
+func hashCachePathFromFlags(c *cli.Command) (string, error) {
+	if path := c.String("cache"); path != "" {
+		return path, nil
+	}
+	path, err := defaultHashCachePath()
+	if err != nil {
+		return "", fmt.Errorf("unable to determine hash cache path, use --cache or --no-cache; %w", err)
+	}
+	return path, nil
+}
+
+func journalPathFromFlags(c *cli.Command) (string, error) {
+	if path := c.String("journal"); path != "" {
+		return path, nil
+	}
+	path, err := defaultJournalPath()
+	if err != nil {
+		return "", fmt.Errorf("unable to determine journal path, use --journal; %w", err)
+	}
+	return path, nil
+}
+
+// strictError returns an error if any paths were skipped and --strict was set.
+func strictError(c *cli.Command, scanErrors []scanError) error {
+	if c.Bool("strict") && len(scanErrors) > 0 {
+		return fmt.Errorf("%d paths were skipped because of errors", len(scanErrors))
+	}
+	return nil
+}
+
+func printHashCacheStats(w io.Writer, cache *hashCache) {
+	if cache == nil {
+		return
+	}
+	hits, misses := cache.Stats()
+	fmt.Fprintf(w, "Hash cache: %d hits, %d misses\n", hits, misses)
+}
+
+var commandUndo = &cli.Command{
+	Name:  "undo",
+	Usage: "Make the files replaced by clone-duplicates independent copies again, using its journal.",
+	Flags: []cli.Flag{
+		&cli.BoolFlag{
+			Name:  "real",
+			Usage: "If we should proceed with copying the replaced files",
+			Value: false,
+		},
+		journalFlag,
+	},
+	Action: func(ctx context.Context, c *cli.Command) error {
+		path, err := journalPathFromFlags(c)
+		if err != nil {
+			return err
+		}
+		entries, err := readJournal(path)
+		if err != nil {
+			return err
+		}
+		entries = slices.DeleteFunc(entries, func(entry journalEntry) bool { return !entry.Replaced() })
+		fmt.Fprintf(os.Stdout, "Using journal %s with %d replacements\n", path, len(entries))
+		real := c.Bool("real")
+		var summary undoSummary
+		// the most recent replacements are undone first.
+		for _, entry := range slices.Backward(entries) {
+			if err := ctx.Err(); err != nil {
+				break
+			}
+			result := undoEntry(ctx, entry, real)
+			summary.Add(result)
+			printUndoResult(os.Stdout, result, real)
+		}
+		if !real {
+			return nil
+		}
+		summary.Print(os.Stdout)
+		if err := ctx.Err(); err != nil {
+			return fmt.Errorf("undo interrupted; %w", err)
+		}
+		if failed := summary.Counts[undoFailed]; failed > 0 {
+			return fmt.Errorf("%d files failed to copy", failed)
 		}
-		fmt.Fprintf(os.Stdout, "Total savings: %s\n", filesize.FormatFraction(totalPossibleSavingsBytes))
 		return nil
 	},
 }
@@ -151,17 +734,30 @@ var commandCloneFile = &cli.Command{
 		sourceFile := c.Args().Get(0)
 		destFile := c.Args().Get(1)
 		fmt.Fprintf(os.Stdout, "Cloning %s to %s\n", truncateStringPrefix(sourceFile, 32), truncateStringPrefix(destFile, 32))
-		if err := cloneFile(sourceFile, destFile); err != nil {
+		problems, err := cloneFile(sourceFile, destFile)
+		if err != nil {
 			return err
 		}
+		printMetadataProblems(os.Stdout, problems)
 		fmt.Fprintf(os.Stdout, "Cloning %s to %s done!\n", truncateStringPrefix(sourceFile, 32), truncateStringPrefix(destFile, 32))
 		return nil
 	},
 }
 
+// Exit codes for same-file, so scripts can branch on how two files are related.
+const (
+	exitCodeHardLink     = 0
+	exitCodeFullClone    = 2
+	exitCodePartialClone = 3
+	exitCodeIndependent  = 4
+)
+
 var commandSameFile = &cli.Command{
-	Name:      "same-file",
-	Usage:     "Test if two files are the same (i.e. one is a clone of the other)",
+	Name:  "same-file",
+	Usage: "Test if two files are the same (i.e. one is a clone of the other)",
+	Description: fmt.Sprintf("Compares the physical extents of two files and exits with %d if they're hard links, "+
+		"%d if they're full clones, %d if they're partial clones, %d if they're independent copies and 1 on error.",
+		exitCodeHardLink, exitCodeFullClone, exitCodePartialClone, exitCodeIndependent),
 	ArgsUsage: "[SOURCE_FILE] [DEST_FILE]",
 	Action: func(ctx context.Context, c *cli.Command) error {
 		if !c.Args().Present() {
@@ -175,122 +771,126 @@ var commandSameFile = &cli.Command{
 
 		sourceInfo, err := os.Stat(sourceFile)
 		if err != nil {
-			fmt.Fprintln(os.Stdout, "[SOURCE_FILE] is missing")
-			return nil
+			return fmt.Errorf("[SOURCE_FILE] is missing; %w", err)
 		}
 		destInfo, err := os.Stat(destFile)
 		if err != nil {
-			fmt.Fprintln(os.Stdout, "[DEST_FILE] is missing")
-			return nil
+			return fmt.Errorf("[DEST_FILE] is missing; %w", err)
 		}
 		if os.SameFile(sourceInfo, destInfo) {
-			fmt.Fprintln(os.Stdout, "Files are the same!")
-			return nil
-		}
-		return fmt.Errorf("Files are not the same!")
-	},
-}
-
-func truncateStringPrefix(s string, length int) string {
-	if len(s) < length {
-		return s
-	}
-	return "..." + string([]rune(s)[length:])
-}
-
-func findDuplicateFiles(targetPath string, minSizeBytes uint64) (hashes map[string][]fullFileInfo, err error) {
-	hashes = make(map[string][]fullFileInfo)
-	err = filepath.Walk(targetPath, filepath.WalkFunc(func(path string, info fs.FileInfo, err error) error {
-		if err != nil {
-			return err
-		}
-		if info.IsDir() {
+			fmt.Fprintln(os.Stdout, "Files are hard links (the same inode)")
 			return nil
 		}
-		if uint64(info.Size()) < minSizeBytes {
-			return nil
+		if !extentsSupported {
+			return fmt.Errorf("Files are not hard links, and extent sharing can't be inspected on this platform")
 		}
-		cs, err := checksumFile(path)
+		sharing, err := fileSharing(fullFileInfo{Path: sourceFile, FileInfo: sourceInfo}, fullFileInfo{Path: destFile, FileInfo: destInfo})
 		if err != nil {
 			return err
 		}
-		for _, existing := range hashes[cs] {
-			if os.SameFile(info, existing) {
-				return nil
-			}
+		switch sharing.Kind() {
+		case sharingFull:
+			fmt.Fprintf(os.Stdout, "Files are full clones (%s shared)\n", filesize.Format(sharing.SharedBytes))
+			return cli.Exit("", exitCodeFullClone)
+		case sharingPartial:
+			fmt.Fprintf(os.Stdout, "Files are partial clones (%s of %s shared, %.1f%%)\n", filesize.Format(sharing.SharedBytes), filesize.Format(sharing.Size), sharing.Percent())
+			return cli.Exit("", exitCodePartialClone)
+		default:
+			fmt.Fprintln(os.Stdout, "Files are independent copies (no shared extents)")
+			return cli.Exit("", exitCodeIndependent)
 		}
-		ffi := fullFileInfo{Path: path, FileInfo: info}
-		if seenFiles, ok := hashes[cs]; ok {
-			hashes[cs] = insertSorted(seenFiles, ffi, func(a, b fullFileInfo) int {
-				if a.ModTime().Before(b.ModTime()) {
-					return -1
+	},
+}
+
+var commandCache = &cli.Command{
+	Name:  "cache",
+	Usage: "Manage the persistent hash cache.",
+	Commands: []*cli.Command{
+		{
+			Name:  "stats",
+			Usage: "Print the location and size of the hash cache.",
+			Flags: []cli.Flag{cacheFlag},
+			Action: func(ctx context.Context, c *cli.Command) error {
+				cache, err := openHashCacheFromFlags(c)
+				if err != nil {
+					return err
 				}
-				if a.ModTime().Equal(b.ModTime()) {
-					return 0
+				fmt.Fprintf(os.Stdout, "Path: %s\n", cache.path)
+				fmt.Fprintf(os.Stdout, "Entries: %d\n", cache.Len())
+				if info, err := os.Stat(cache.path); err == nil {
+					fmt.Fprintf(os.Stdout, "Size: %s\n", filesize.FormatFraction(uint64(info.Size())))
 				}
-				return 1
-			})
-		} else {
-			hashes[cs] = []fullFileInfo{ffi}
-		}
+				return nil
+			},
+		},
+		{
+			Name:  "prune",
+			Usage: "Remove entries for files that no longer exist or have changed.",
+			Flags: []cli.Flag{cacheFlag},
+			Action: func(ctx context.Context, c *cli.Command) error {
+				cache, err := openHashCacheFromFlags(c)
+				if err != nil {
+					return err
+				}
+				removed := cache.Prune()
+				if err := cache.Save(); err != nil {
+					return err
+				}
+				fmt.Fprintf(os.Stdout, "Pruned %d entries, %d remain\n", removed, cache.Len())
+				return nil
+			},
+		},
+		{
+			Name:  "clear",
+			Usage: "Remove the hash cache entirely.",
+			Flags: []cli.Flag{cacheFlag},
+			Action: func(ctx context.Context, c *cli.Command) error {
+				// the cache isn't opened, so that one that can't be parsed can still be cleared.
+				path, err := hashCachePathFromFlags(c)
+				if err != nil {
+					return err
+				}
+				if err := newHashCache(path).Remove(); err != nil {
+					return err
+				}
+				fmt.Fprintf(os.Stdout, "Cleared %s\n", path)
+				return nil
+			},
+		},
+	},
+	Action: func(ctx context.Context, cmd *cli.Command) error {
+		cli.ShowSubcommandHelp(cmd)
 		return nil
-	}))
-	return
+	},
 }
 
-type fullFileInfo struct {
-	fs.FileInfo
-	Path string
-}
+const (
+	methodClone    = "clone"
+	methodDedupe   = "dedupe"
+	methodHardlink = "hardlink"
+)
 
-func cloneFile(source, target string) error {
-	sourceAbsolute, err := filepath.Abs(source)
-	if err != nil {
-		return fmt.Errorf("clone-file failed: unable to make source path absolute; %w", err)
-	}
-	targetAbsolute, err := filepath.Abs(target)
-	if err != nil {
-		return fmt.Errorf("clone-file failed: unable to make target path absolute; %w", err)
-	}
-	if !fileExists(sourceAbsolute) {
-		return fmt.Errorf("clone-file failed: source not found; %s", sourceAbsolute)
-	}
-	targetExists := fileExists(targetAbsolute)
-	if targetExists {
-		_ = os.Remove(targetAbsolute)
+func printCrossDeviceDuplicates(w io.Writer, crossDevice []duplicateGroup) {
+	if len(crossDevice) == 0 {
+		return
 	}
-	if err := unix.Clonefile(sourceAbsolute, targetAbsolute, unix.CLONE_NOFOLLOW); err != nil {
-		if !errors.Is(err, unix.ENOTSUP) && !errors.Is(err, unix.EXDEV) {
-			return fmt.Errorf("clone-file failed: %w", err)
+	fmt.Fprintln(w, "Duplicates that cannot be cloned (on different devices):")
+	for _, group := range crossDevice {
+		srcFile := group.Files[0]
+		for _, fileInfo := range group.Files[1:] {
+			fmt.Fprintf(w, "\t%s (device %d) is a duplicate of %s (device %d)\n", truncateStringPrefix(fileInfo.Path, 32), fileInfo.Device(), truncateStringPrefix(srcFile.Path, 32), srcFile.Device())
 		}
 	}
-	return nil
 }
 
-func fileExists(target string) bool {
-	_, err := os.Stat(target)
-	return err == nil
-}
-
-func checksumFile(path string) (checksum string, err error) {
-	var f *os.File
-	f, err = os.Open(path)
-	if err != nil {
-		return
-	}
-	defer f.Close()
-	h := sha256.New()
-	if _, err = io.Copy(h, f); err != nil {
-		return
+func truncateStringPrefix(s string, length int) string {
+	if len(s) < length {
+		return s
 	}
-	checksum = hex.EncodeToString(h.Sum(nil))
-	return
+	return "..." + string([]rune(s)[length:])
 }
 
-func insertSorted[A any](working []A, v A, sorter func(A, A) int) []A {
-	insertAt, _ := slices.BinarySearchFunc(working, v, sorter)
-	working = append(working, v)
-	copy(working[insertAt+1:], working[insertAt:])
-	working[insertAt] = v
-	return working
+func fileExists(target string) bool {
+	_, err := os.Stat(target)
+	return err == nil
 }
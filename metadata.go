@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"slices"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// metadataProblem is a piece of a file's metadata that couldn't be restored onto its replacement.
+type metadataProblem struct {
+	What string
+	Err  error
+}
+
+func (mp metadataProblem) String() string {
+	return fmt.Sprintf("%s: %v", mp.What, mp.Err)
+}
+
+// restoreMetadata makes the replacement of a file look like the original did, restoring its
+// owner, mode, extended attributes (which include security labels and POSIX ACLs on linux),
+// inode flags and timestamps. It's applied before the replacement is renamed over the original.
+//
+// Anything that can't be restored is returned rather than failing the replacement,
+// e.g. when we don't have permission to give a file to another owner.
+func restoreMetadata(original fs.FileInfo, originalPath, replacementPath string) (problems []metadataProblem) {
+	st, ok := statOf(original)
+	if !ok {
+		return []metadataProblem{{What: "owner", Err: errors.ErrUnsupported}}
+	}
+	// changing the owner clears setuid and setgid bits and file capabilities,
+	// so it's done before the mode and extended attributes are restored.
+	if err := os.Lchown(replacementPath, int(st.Uid), int(st.Gid)); err != nil {
+		problems = append(problems, metadataProblem{What: "owner", Err: err})
+	}
+	if err := os.Chmod(replacementPath, original.Mode()&(fs.ModePerm|fs.ModeSetuid|fs.ModeSetgid|fs.ModeSticky)); err != nil {
+		problems = append(problems, metadataProblem{What: "mode", Err: err})
+	}
+	problems = append(problems, restoreXattrs(originalPath, replacementPath)...)
+	problems = append(problems, restoreInodeFlags(originalPath, replacementPath)...)
+	// the timestamps are restored last, as setting anything else can touch them.
+	if err := os.Chtimes(replacementPath, time.Unix(0, st.Atime), original.ModTime()); err != nil {
+		problems = append(problems, metadataProblem{What: "timestamps", Err: err})
+	}
+	return
+}
+
+// restoreXattrs sets the extended attributes of the replacement to exactly those of the original.
+func restoreXattrs(originalPath, replacementPath string) (problems []metadataProblem) {
+	names, err := listXattrs(originalPath)
+	if err != nil {
+		if isXattrUnsupported(err) {
+			return nil
+		}
+		return []metadataProblem{{What: "xattrs", Err: err}}
+	}
+	existing, err := listXattrs(replacementPath)
+	if err != nil && !isXattrUnsupported(err) {
+		return []metadataProblem{{What: "xattrs", Err: err}}
+	}
+	for _, name := range existing {
+		if slices.Contains(names, name) {
+			continue
+		}
+		if err := unix.Removexattr(replacementPath, name); err != nil {
+			problems = append(problems, metadataProblem{What: "xattr " + name, Err: err})
+		}
+	}
+	for _, name := range names {
+		value, err := getXattr(originalPath, name)
+		if err != nil {
+			problems = append(problems, metadataProblem{What: "xattr " + name, Err: err})
+			continue
+		}
+		if current, err := getXattr(replacementPath, name); err == nil && bytes.Equal(current, value) {
+			continue
+		}
+		if err := unix.Setxattr(replacementPath, name, value, 0); err != nil {
+			problems = append(problems, metadataProblem{What: "xattr " + name, Err: err})
+		}
+	}
+	return
+}
+
+// listXattrs returns the names of the extended attributes of a file.
+func listXattrs(path string) ([]string, error) {
+	buf, err := readXattr(func(dest []byte) (int, error) { return unix.Listxattr(path, dest) })
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for name := range bytes.SplitSeq(buf, []byte{0}) {
+		if len(name) > 0 {
+			names = append(names, string(name))
+		}
+	}
+	return names, nil
+}
+
+// getXattr returns the value of an extended attribute of a file.
+func getXattr(path, name string) ([]byte, error) {
+	return readXattr(func(dest []byte) (int, error) { return unix.Getxattr(path, name, dest) })
+}
+
+// readXattr calls an xattr syscall with a buffer big enough for its result,
+// retrying if the value grows between asking for its size and reading it.
+func readXattr(call func(dest []byte) (int, error)) ([]byte, error) {
+	for {
+		size, err := call(nil)
+		if err != nil {
+			return nil, err
+		}
+		if size == 0 {
+			return nil, nil
+		}
+		buf := make([]byte, size)
+		size, err = call(buf)
+		if errors.Is(err, unix.ERANGE) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return buf[:size], nil
+	}
+}
+
+// isXattrUnsupported returns if an error means the filesystem doesn't support extended attributes.
+func isXattrUnsupported(err error) bool {
+	return errors.Is(err, unix.ENOTSUP) || errors.Is(err, unix.EOPNOTSUPP)
+}
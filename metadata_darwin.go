@@ -0,0 +1,6 @@
+package main
+
+// restoreInodeFlags is a no-op on darwin, inode flags are only restored on linux.
+func restoreInodeFlags(originalPath, replacementPath string) []metadataProblem {
+	return nil
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	fsImmutableFl = 0x00000010
+	fsAppendFl    = 0x00000020
+)
+
+// restoreInodeFlags copies the inode flags (as set by chattr(1)) of the original onto the replacement.
+//
+// Immutable and append only flags aren't restored, as they would stop the replacement from being
+// renamed over the original (which a file with them couldn't be replaced by anyway).
+func restoreInodeFlags(originalPath, replacementPath string) (problems []metadataProblem) {
+	flags, err := inodeFlags(originalPath)
+	if err != nil {
+		if isInodeFlagsUnsupported(err) {
+			return nil
+		}
+		return []metadataProblem{{What: "inode flags", Err: err}}
+	}
+	if locked := flags & (fsImmutableFl | fsAppendFl); locked != 0 {
+		problems = append(problems, metadataProblem{What: "inode flags", Err: fmt.Errorf("immutable or append only flags (%#x) are not restored", locked)})
+		flags &^= locked
+	}
+	current, err := inodeFlags(replacementPath)
+	if err != nil {
+		return append(problems, metadataProblem{What: "inode flags", Err: err})
+	}
+	if current == flags {
+		return
+	}
+	f, err := os.OpenFile(replacementPath, os.O_RDONLY|unix.O_NONBLOCK, 0)
+	if err != nil {
+		return append(problems, metadataProblem{What: "inode flags", Err: err})
+	}
+	defer f.Close()
+	if err := unix.IoctlSetPointerInt(int(f.Fd()), unix.FS_IOC_SETFLAGS, int(flags)); err != nil {
+		problems = append(problems, metadataProblem{What: "inode flags", Err: err})
+	}
+	return
+}
+
+// inodeFlags returns the inode flags of a file with the FS_IOC_GETFLAGS ioctl.
+func inodeFlags(path string) (uint32, error) {
+	f, err := os.OpenFile(path, os.O_RDONLY|unix.O_NONBLOCK, 0)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	return unix.IoctlGetUint32(int(f.Fd()), unix.FS_IOC_GETFLAGS)
+}
+
+// isInodeFlagsUnsupported returns if an error means the filesystem doesn't have inode flags.
+func isInodeFlagsUnsupported(err error) bool {
+	return errors.Is(err, unix.ENOTTY) || errors.Is(err, unix.ENOTSUP) || errors.Is(err, unix.EOPNOTSUPP) || errors.Is(err, unix.EINVAL)
+}
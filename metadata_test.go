@@ -0,0 +1,80 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+func Test_restoreMetadata(t *testing.T) {
+	tempDir := t.TempDir()
+	original, replacement := filepath.Join(tempDir, "original"), filepath.Join(tempDir, "replacement")
+	if err := os.WriteFile(original, []byte("hello world"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(replacement, []byte("hello world"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := unix.Setxattr(original, "user.space-saver.kept", []byte("original"), 0); err != nil {
+		if errors.Is(err, unix.ENOTSUP) || errors.Is(err, unix.EOPNOTSUPP) {
+			t.Skip("extended attributes aren't supported here")
+		}
+		t.Fatal(err)
+	}
+	if err := unix.Setxattr(replacement, "user.space-saver.removed", []byte("replacement"), 0); err != nil {
+		t.Fatal(err)
+	}
+	modTime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	accessTime := time.Date(2021, 1, 2, 3, 4, 5, 0, time.UTC)
+	if err := os.Chtimes(original, accessTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+	originalInfo, err := os.Stat(original)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if problems := restoreMetadata(originalInfo, original, replacement); len(problems) != 0 {
+		t.Errorf("Expected no problems vs. Actual=%v", problems)
+	}
+
+	info, err := os.Stat(replacement)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode() != originalInfo.Mode() {
+		t.Errorf("Expected mode=%v vs. Actual=%v", originalInfo.Mode(), info.Mode())
+	}
+	if !info.ModTime().Equal(modTime) {
+		t.Errorf("Expected mod time=%v vs. Actual=%v", modTime, info.ModTime())
+	}
+	st, _ := statOf(info)
+	if actual := time.Unix(0, st.Atime); !actual.Equal(accessTime) {
+		t.Errorf("Expected access time=%v vs. Actual=%v", accessTime, actual)
+	}
+	names, err := listXattrs(replacement)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var userNames []string
+	for _, name := range names {
+		if strings.HasPrefix(name, "user.") {
+			userNames = append(userNames, name)
+		}
+	}
+	if len(userNames) != 1 || userNames[0] != "user.space-saver.kept" {
+		t.Errorf("Expected user xattrs=[user.space-saver.kept] vs. Actual=%v", userNames)
+	}
+	value, err := getXattr(replacement, "user.space-saver.kept")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(value) != "original" {
+		t.Errorf("Expected xattr value=original vs. Actual=%s", value)
+	}
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Output formats for find.
+const (
+	outputText   = "text"
+	outputJSON   = "json"
+	outputNDJSON = "ndjson"
+	outputCSV    = "csv"
+)
+
+// outputFormats are the output formats for find, in the order they're listed in help.
+var outputFormats = []string{outputText, outputJSON, outputNDJSON, outputCSV}
+
+// outputSchemaVersion is the version of the machine readable output, and only changes
+// if fields are removed or change meaning (fields may be added without changing it).
+const outputSchemaVersion = 1
+
+// groupRecord is the machine readable form of a set of duplicates.
+type groupRecord struct {
+	Hash      string `json:"hash"`
+	Algorithm string `json:"algorithm"`
+	// Size is the size of each file in bytes.
+	Size int64 `json:"size"`
+	// Blocks is the total number of 512 byte blocks allocated to the files (which counts shared blocks once per file).
+	Blocks int64 `json:"blocks"`
+	// Device is the device of the files, it is zero for cross device groups.
+	Device uint64 `json:"device"`
+	// CrossDevice is true if the files are on different devices and can't be cloned.
+	CrossDevice bool `json:"cross_device"`
+	// Source is the path of the file that would be kept.
+	Source string `json:"source"`
+	// Members are all the files, starting with the source.
+	Members []memberRecord `json:"members"`
+	// Reclaimable is the number of bytes that could be saved by cloning the group.
+	Reclaimable uint64 `json:"reclaimable"`
+}
+
+// memberRecord is the machine readable form of a file in a set of duplicates.
+type memberRecord struct {
+	Path   string `json:"path"`
+	Device uint64 `json:"device"`
+	Blocks int64  `json:"blocks"`
+	// Sharing is how much of the file already shares storage with the source; one of none, partial or full
+	// (or source, for the source itself).
+	Sharing     string `json:"sharing"`
+	SharedBytes uint64 `json:"shared_bytes"`
+	Reclaimable uint64 `json:"reclaimable"`
+}
+
+// sharingName returns the name of a sharing kind as used in machine readable output.
+func sharingName(sk sharingKind) string {
+	switch sk {
+	case sharingPartial:
+		return "partial"
+	case sharingFull:
+		return "full"
+	default:
+		return "none"
+	}
+}
+
+// groupRecords returns the machine readable form of the groups of a scan,
+// with the cross device groups after the others.
+func groupRecords(result scanResult) (records []groupRecord, err error) {
+	for _, group := range result.Groups {
+		var record groupRecord
+		record, err = newGroupRecord(result.Algorithm, group)
+		if err != nil {
+			return
+		}
+		record.Device = group.Device
+		for index := range record.Members[1:] {
+			sharing := group.Sharing[index+1]
+			record.Members[index+1].Sharing = sharingName(sharing.Kind())
+			record.Members[index+1].SharedBytes = sharing.SharedBytes
+			record.Members[index+1].Reclaimable = sharing.Reclaimable()
+		}
+		record.Reclaimable = group.Reclaimable()
+		records = append(records, record)
+	}
+	for _, group := range result.CrossDevice {
+		var record groupRecord
+		record, err = newGroupRecord(result.Algorithm, group)
+		if err != nil {
+			return
+		}
+		record.CrossDevice = true
+		for index := range record.Members[1:] {
+			record.Members[index+1].Sharing = sharingName(sharingNone)
+		}
+		records = append(records, record)
+	}
+	return
+}
+
+// newGroupRecord returns the record of a group, with its paths made absolute
+// so that they can be used from any directory.
+func newGroupRecord(algorithm string, group duplicateGroup) (groupRecord, error) {
+	record := groupRecord{
+		Hash:      group.Checksum,
+		Algorithm: algorithm,
+		Size:      group.Files[0].Size(),
+	}
+	for _, ffi := range group.Files {
+		path, err := filepath.Abs(ffi.Path)
+		if err != nil {
+			return groupRecord{}, err
+		}
+		st, _ := statOf(ffi.FileInfo)
+		record.Blocks += st.Blocks
+		record.Members = append(record.Members, memberRecord{Path: path, Device: st.Dev, Blocks: st.Blocks})
+	}
+	record.Source = record.Members[0].Path
+	record.Members[0].Sharing = "source"
+	return record, nil
+}
+
+// groupWriter writes group records in a machine readable format.
+type groupWriter interface {
+	Write(groupRecord) error
+	// Close finishes the output, it doesn't close the underlying writer.
+	Close() error
+}
+
+// newGroupWriter returns a writer for a machine readable output format.
+func newGroupWriter(format string, w io.Writer) (groupWriter, error) {
+	switch format {
+	case outputJSON:
+		return &jsonGroupWriter{w: w}, nil
+	case outputNDJSON:
+		return &ndjsonGroupWriter{enc: json.NewEncoder(w)}, nil
+	case outputCSV:
+		return &csvGroupWriter{w: csv.NewWriter(w)}, nil
+	default:
+		return nil, fmt.Errorf("unknown output format %q; must be one of %s", format, strings.Join(outputFormats, ", "))
+	}
+}
+
+// jsonGroupWriter writes a single document with all the groups once it's closed.
+type jsonGroupWriter struct {
+	w      io.Writer
+	groups []groupRecord
+}
+
+func (jw *jsonGroupWriter) Write(record groupRecord) error {
+	jw.groups = append(jw.groups, record)
+	return nil
+}
+
+func (jw *jsonGroupWriter) Close() error {
+	doc := struct {
+		SchemaVersion int           `json:"schema_version"`
+		Groups        []groupRecord `json:"groups"`
+	}{
+		SchemaVersion: outputSchemaVersion,
+		Groups:        jw.groups,
+	}
+	if doc.Groups == nil {
+		doc.Groups = []groupRecord{}
+	}
+	enc := json.NewEncoder(jw.w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(doc)
+}
+
+// ndjsonGroupWriter writes each group as a line of JSON.
+type ndjsonGroupWriter struct {
+	enc *json.Encoder
+}
+
+func (nw *ndjsonGroupWriter) Write(record groupRecord) error {
+	return nw.enc.Encode(record)
+}
+
+func (nw *ndjsonGroupWriter) Close() error { return nil }
+
+// csvHeader are the columns of the csv output, which has a row per member of each group.
+var csvHeader = []string{
+	"hash", "algorithm", "size", "cross_device", "source",
+	"path", "device", "blocks", "sharing", "shared_bytes", "reclaimable",
+}
+
+// csvGroupWriter writes a row for each member of each group, after a header row.
+type csvGroupWriter struct {
+	w           *csv.Writer
+	wroteHeader bool
+}
+
+func (cw *csvGroupWriter) Write(record groupRecord) error {
+	if !cw.wroteHeader {
+		if err := cw.w.Write(csvHeader); err != nil {
+			return err
+		}
+		cw.wroteHeader = true
+	}
+	for _, member := range record.Members {
+		row := []string{
+			record.Hash,
+			record.Algorithm,
+			strconv.FormatInt(record.Size, 10),
+			strconv.FormatBool(record.CrossDevice),
+			record.Source,
+			member.Path,
+			strconv.FormatUint(member.Device, 10),
+			strconv.FormatInt(member.Blocks, 10),
+			member.Sharing,
+			strconv.FormatUint(member.SharedBytes, 10),
+			strconv.FormatUint(member.Reclaimable, 10),
+		}
+		if err := cw.w.Write(row); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (cw *csvGroupWriter) Close() error {
+	if !cw.wroteHeader {
+		if err := cw.w.Write(csvHeader); err != nil {
+			return err
+		}
+	}
+	cw.w.Flush()
+	return cw.w.Error()
+}
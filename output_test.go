@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func Test_groupWriter(t *testing.T) {
+	records := []groupRecord{
+		{
+			Hash: "abc", Algorithm: "sha256", Size: 11, Blocks: 16, Device: 1, Source: "a, with a comma",
+			Members: []memberRecord{
+				{Path: "a, with a comma", Device: 1, Blocks: 8, Sharing: "source"},
+				{Path: "b", Device: 1, Blocks: 8, Sharing: "none", Reclaimable: 11},
+			},
+			Reclaimable: 11,
+		},
+		{
+			Hash: "def", Algorithm: "sha256", Size: 5, Blocks: 16, CrossDevice: true, Source: "c",
+			Members: []memberRecord{
+				{Path: "c", Device: 1, Blocks: 8, Sharing: "source"},
+				{Path: "d", Device: 2, Blocks: 8, Sharing: "none"},
+			},
+		},
+	}
+
+	testCases := [...]struct {
+		Format   string
+		Expected string
+	}{
+		{outputNDJSON, `{"hash":"abc","algorithm":"sha256","size":11,"blocks":16,"device":1,"cross_device":false,"source":"a, with a comma","members":[{"path":"a, with a comma","device":1,"blocks":8,"sharing":"source","shared_bytes":0,"reclaimable":0},{"path":"b","device":1,"blocks":8,"sharing":"none","shared_bytes":0,"reclaimable":11}],"reclaimable":11}
+{"hash":"def","algorithm":"sha256","size":5,"blocks":16,"device":0,"cross_device":true,"source":"c","members":[{"path":"c","device":1,"blocks":8,"sharing":"source","shared_bytes":0,"reclaimable":0},{"path":"d","device":2,"blocks":8,"sharing":"none","shared_bytes":0,"reclaimable":0}],"reclaimable":0}
+`},
+		{outputCSV, `hash,algorithm,size,cross_device,source,path,device,blocks,sharing,shared_bytes,reclaimable
+abc,sha256,11,false,"a, with a comma","a, with a comma",1,8,source,0,0
+abc,sha256,11,false,"a, with a comma",b,1,8,none,0,11
+def,sha256,5,true,c,c,1,8,source,0,0
+def,sha256,5,true,c,d,2,8,none,0,0
+`},
+	}
+
+	for _, tc := range testCases {
+		buf := new(bytes.Buffer)
+		gw, err := newGroupWriter(tc.Format, buf)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		for _, record := range records {
+			if err := gw.Write(record); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+		}
+		if err := gw.Close(); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if actual := buf.String(); actual != tc.Expected {
+			t.Errorf("Input=%s Expected=%s vs. Actual=%s", tc.Format, tc.Expected, actual)
+		}
+	}
+}
+
+func Test_groupWriter_json(t *testing.T) {
+	buf := new(bytes.Buffer)
+	gw, err := newGroupWriter(outputJSON, buf)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := gw.Close(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var doc map[string]any
+	if err := json.NewDecoder(strings.NewReader(buf.String())).Decode(&doc); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if doc["schema_version"] != float64(outputSchemaVersion) {
+		t.Errorf("Expected schema_version=%d vs. Actual=%v", outputSchemaVersion, doc["schema_version"])
+	}
+	if groups, ok := doc["groups"].([]any); !ok || len(groups) != 0 {
+		t.Errorf("Expected groups=[] vs. Actual=%v", doc["groups"])
+	}
+}
+
+func Test_groupRecords_absolutePaths(t *testing.T) {
+	tempDir := t.TempDir()
+	for _, name := range []string{"a", "b"} {
+		if err := os.WriteFile(filepath.Join(tempDir, name), []byte("hello world"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Chdir(tempDir)
+	result, err := findDuplicateFiles(t.Context(), []string{"."}, scanOptions{Jobs: 2})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	records, err := groupRecords(result)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(records) != 1 {
+		t.Fatalf("Expected=1 record vs. Actual=%d", len(records))
+	}
+	if expected := filepath.Join(tempDir, "a"); records[0].Source != expected {
+		t.Errorf("Expected source=%s vs. Actual=%s", expected, records[0].Source)
+	}
+	for index, name := range []string{"a", "b"} {
+		if expected := filepath.Join(tempDir, name); records[0].Members[index].Path != expected {
+			t.Errorf("Input=%d Expected=%s vs. Actual=%s", index, expected, records[0].Members[index].Path)
+		}
+	}
+}
@@ -0,0 +1,51 @@
+package ignore
+
+import (
+	"bufio"
+	"os"
+)
+
+// Matcher decides if paths are ignored by a list of patterns.
+//
+// As with gitignore, the last pattern that matches a path wins.
+type Matcher struct {
+	patterns []Pattern
+}
+
+// Add adds patterns to the matcher; they take precedence over the patterns already added.
+func (m *Matcher) Add(patterns ...Pattern) {
+	m.patterns = append(m.patterns, patterns...)
+}
+
+// Len returns the number of patterns in the matcher.
+func (m *Matcher) Len() int {
+	return len(m.patterns)
+}
+
+// Match returns if a slash separated path, relative to the root of the walk, matches
+// any of the patterns, taking negated patterns into account.
+func (m *Matcher) Match(relPath string, isDir bool) bool {
+	for i := len(m.patterns) - 1; i >= 0; i-- {
+		if m.patterns[i].Match(relPath, isDir) {
+			return !m.patterns[i].Negated()
+		}
+	}
+	return false
+}
+
+// ReadFile reads the patterns of an ignore file, relative to a given base directory.
+func ReadFile(path, base string) (patterns []Pattern, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if p, ok := ParsePattern(scanner.Text(), base); ok {
+			patterns = append(patterns, p)
+		}
+	}
+	err = scanner.Err()
+	return
+}
@@ -0,0 +1,108 @@
+package ignore
+
+import (
+	"path"
+	"strings"
+)
+
+// Pattern is a single gitignore style pattern.
+type Pattern struct {
+	// Base is the slash separated directory, relative to the root of the walk,
+	// that the pattern was read from. Patterns only apply to paths within their base.
+	Base string
+
+	negate   bool
+	dirOnly  bool
+	anchored bool
+	segments []string
+}
+
+// ParsePattern parses a single line of an ignore file.
+//
+// It returns false if the line is blank or a comment.
+func ParsePattern(line, base string) (p Pattern, ok bool) {
+	line = strings.TrimRight(line, " \t\r")
+	if line == "" || strings.HasPrefix(line, "#") {
+		return
+	}
+	p.Base = strings.Trim(base, "/")
+	if p.Base == "." {
+		p.Base = ""
+	}
+	if strings.HasPrefix(line, "!") {
+		p.negate = true
+		line = line[1:]
+	} else if strings.HasPrefix(line, `\!`) || strings.HasPrefix(line, `\#`) {
+		line = line[1:]
+	}
+	if strings.HasSuffix(line, "/") {
+		p.dirOnly = true
+		line = strings.TrimRight(line, "/")
+	}
+	if line == "" {
+		return
+	}
+	// a pattern with a slash anywhere but the end is relative to its base,
+	// otherwise it can match at any depth.
+	if strings.Contains(line, "/") {
+		p.anchored = true
+		line = strings.TrimPrefix(line, "/")
+	}
+	p.segments = strings.Split(line, "/")
+	ok = true
+	return
+}
+
+// Negated returns if the pattern re-includes paths (i.e. it started with a "!").
+func (p Pattern) Negated() bool {
+	return p.negate
+}
+
+// Match returns if a slash separated path, relative to the root of the walk, matches the pattern.
+func (p Pattern) Match(relPath string, isDir bool) bool {
+	if p.dirOnly && !isDir {
+		return false
+	}
+	if p.Base != "" {
+		if !strings.HasPrefix(relPath, p.Base+"/") {
+			return false
+		}
+		relPath = relPath[len(p.Base)+1:]
+	}
+	if relPath == "" || relPath == "." {
+		return false
+	}
+	parts := strings.Split(relPath, "/")
+	if !p.anchored {
+		matched, _ := path.Match(p.segments[0], parts[len(parts)-1])
+		return matched
+	}
+	return matchSegments(p.segments, parts)
+}
+
+// matchSegments matches pattern segments against path segments, where a "**"
+// segment matches zero or more path segments.
+func matchSegments(segments, parts []string) bool {
+	for len(segments) > 0 {
+		if segments[0] == "**" {
+			rest := segments[1:]
+			if len(rest) == 0 {
+				return len(parts) > 0
+			}
+			for i := 0; i <= len(parts); i++ {
+				if matchSegments(rest, parts[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(parts) == 0 {
+			return false
+		}
+		if matched, _ := path.Match(segments[0], parts[0]); !matched {
+			return false
+		}
+		segments, parts = segments[1:], parts[1:]
+	}
+	return len(parts) == 0
+}
@@ -0,0 +1,63 @@
+package ignore
+
+import "testing"
+
+func Test_Pattern_Match(t *testing.T) {
+	testCases := [...]struct {
+		Pattern  string
+		Base     string
+		Path     string
+		IsDir    bool
+		Expected bool
+	}{
+		{"*.tmp", "", "foo.tmp", false, true},
+		{"*.tmp", "", "a/b/foo.tmp", false, true},
+		{"*.tmp", "", "a/b/foo.txt", false, false},
+		{".git", "", "a/.git", true, true},
+		{"node_modules/", "", "a/node_modules", true, true},
+		{"node_modules/", "", "a/node_modules", false, false},
+		{"/build", "", "build", true, true},
+		{"/build", "", "a/build", true, false},
+		{"a/*.iso", "", "a/disk.iso", false, true},
+		{"a/*.iso", "", "b/a/disk.iso", false, false},
+		{"**/snapshots", "", "x/y/snapshots", true, true},
+		{"**/snapshots", "", "snapshots", true, true},
+		{"media/**", "", "media/a/b.mkv", false, true},
+		{"media/**", "", "media", true, false},
+		{"a/**/b", "", "a/b", true, true},
+		{"a/**/b", "", "a/x/y/b", true, true},
+		{"*.tmp", "sub", "foo.tmp", false, false},
+		{"*.tmp", "sub", "sub/foo.tmp", false, true},
+		{"/cache", "sub", "sub/cache", true, true},
+		{"/cache", "sub", "sub/x/cache", true, false},
+	}
+
+	for _, tc := range testCases {
+		p, ok := ParsePattern(tc.Pattern, tc.Base)
+		if !ok {
+			t.Errorf("Pattern=%s unexpectedly failed to parse", tc.Pattern)
+			continue
+		}
+		if actual := p.Match(tc.Path, tc.IsDir); actual != tc.Expected {
+			t.Errorf("Pattern=%s Base=%s Path=%s Expected=%v vs. Actual=%v", tc.Pattern, tc.Base, tc.Path, tc.Expected, actual)
+		}
+	}
+}
+
+func Test_Matcher_Negate(t *testing.T) {
+	var m Matcher
+	for _, line := range []string{"# comment", "", "*.log", "!keep.log"} {
+		if p, ok := ParsePattern(line, ""); ok {
+			m.Add(p)
+		}
+	}
+	if m.Len() != 2 {
+		t.Errorf("Expected=2 patterns vs. Actual=%d", m.Len())
+	}
+	if !m.Match("a/debug.log", false) {
+		t.Errorf("Expected a/debug.log to match")
+	}
+	if m.Match("a/keep.log", false) {
+		t.Errorf("Expected a/keep.log to be re-included")
+	}
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// errPlanPrecondition is returned when a file no longer matches what it was when a plan was made.
+var errPlanPrecondition = errors.New("plan precondition failed")
+
+// planVersion is the version of the plan file format.
+const planVersion = 1
+
+// plan is a reviewed set of replacements written by find and applied by clone-duplicates,
+// so that what's applied is exactly what was reviewed.
+type plan struct {
+	Version int `json:"version"`
+	// Algorithm is the name of the hash algorithm of the action checksums.
+	Algorithm string       `json:"algorithm"`
+	Actions   []planAction `json:"actions"`
+}
+
+// planAction replaces a target with a clone of a source, if both still match their preconditions.
+type planAction struct {
+	// Hash is the checksum that both files must still have.
+	Hash   string   `json:"hash"`
+	Source planFile `json:"source"`
+	Target planFile `json:"target"`
+}
+
+// planFile is a file of a plan action and the size and modification time it must still have.
+type planFile struct {
+	Path    string    `json:"path"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mtime"`
+}
+
+// newPlanFile returns the plan file for a file, with its path made absolute so that
+// the plan can be applied from any directory.
+func newPlanFile(ffi fullFileInfo) (planFile, error) {
+	path, err := filepath.Abs(ffi.Path)
+	if err != nil {
+		return planFile{}, err
+	}
+	return planFile{Path: path, Size: ffi.Size(), ModTime: ffi.ModTime()}, nil
+}
+
+// newPlan returns the actions clone-duplicates would take for the groups of a scan,
+// leaving out files that already fully share storage with their source.
+func newPlan(result scanResult) (p plan, err error) {
+	p = plan{Version: planVersion, Algorithm: result.Algorithm, Actions: []planAction{}}
+	for _, group := range result.Groups {
+		var source planFile
+		source, err = newPlanFile(group.Files[0])
+		if err != nil {
+			return
+		}
+		for index, ffi := range group.Files[1:] {
+			if group.Sharing[index+1].Kind() == sharingFull {
+				continue
+			}
+			var target planFile
+			target, err = newPlanFile(ffi)
+			if err != nil {
+				return
+			}
+			p.Actions = append(p.Actions, planAction{Hash: group.Checksum, Source: source, Target: target})
+		}
+	}
+	return
+}
+
+// writePlan writes a plan to a file.
+func writePlan(path string, p plan) error {
+	contents, err := json.MarshalIndent(p, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(path, append(contents, '\n')); err != nil {
+		return fmt.Errorf("plan: unable to write %s; %w", path, err)
+	}
+	return nil
+}
+
+// readPlan reads a plan from a file.
+func readPlan(path string) (p plan, err error) {
+	var contents []byte
+	contents, err = os.ReadFile(path)
+	if err != nil {
+		err = fmt.Errorf("plan: unable to read %s; %w", path, err)
+		return
+	}
+	if err = json.Unmarshal(contents, &p); err != nil {
+		err = fmt.Errorf("plan: unable to parse %s; %w", path, err)
+		return
+	}
+	if p.Version != planVersion {
+		err = fmt.Errorf("plan: unsupported version %d in %s; expected %d", p.Version, path, planVersion)
+		return
+	}
+	if _, err = parseHasher(p.Algorithm); err != nil {
+		err = fmt.Errorf("plan: %s; %w", path, err)
+	}
+	return
+}
+
+// planChecker checks that the files of plan actions still match their preconditions.
+type planChecker struct {
+	hasher hasher
+	caches []*hashCache
+	// passed are the files that have already passed their preconditions, so that
+	// a source shared by many actions is only hashed once.
+	passed map[string]fullFileInfo
+}
+
+func newPlanChecker(hasher hasher, cache *hashCache) *planChecker {
+	pc := &planChecker{hasher: hasher, passed: make(map[string]fullFileInfo)}
+	if cache != nil {
+		pc.caches = append(pc.caches, cache)
+	}
+	return pc
+}
+
+// Seed marks the files of a scan as having passed their preconditions as they were when they were hashed,
+// so that they're only checked against what was hashed rather than hashed again.
+func (pc *planChecker) Seed(result scanResult) {
+	for _, group := range result.Groups {
+		for _, ffi := range group.Files {
+			if abs, err := filepath.Abs(ffi.Path); err == nil {
+				pc.passed[abs] = ffi
+			}
+		}
+	}
+}
+
+// Check returns the current state of a file of an action, or an error if it no longer has
+// the size, modification time or checksum it had when the plan was made.
+func (pc *planChecker) Check(ctx context.Context, hash string, file planFile) (fullFileInfo, error) {
+	info, err := os.Stat(file.Path)
+	if err != nil {
+		return fullFileInfo{}, err
+	}
+	ffi := fullFileInfo{Path: file.Path, FileInfo: info}
+	if passed, ok := pc.passed[file.Path]; ok && !changedSinceHash(passed, info) && os.SameFile(passed.FileInfo, info) {
+		return ffi, nil
+	}
+	if !info.Mode().IsRegular() {
+		return ffi, fmt.Errorf("%w: not a regular file", errPlanPrecondition)
+	}
+	if info.Size() != file.Size {
+		return ffi, fmt.Errorf("%w: size is %d, expected %d", errPlanPrecondition, info.Size(), file.Size)
+	}
+	if !info.ModTime().Equal(file.ModTime) {
+		return ffi, fmt.Errorf("%w: modified at %v, expected %v", errPlanPrecondition, info.ModTime(), file.ModTime)
+	}
+	cs, err := cachedChecksum(pc.caches, ffi, pc.hasher.Name(), func() (string, error) {
+		return checksumFile(ctx, pc.hasher, file.Path)
+	})
+	if err != nil {
+		return ffi, err
+	}
+	if cs != hash {
+		return ffi, fmt.Errorf("%w: %s checksum is %s, expected %s", errPlanPrecondition, pc.hasher.Name(), cs, hash)
+	}
+	pc.passed[file.Path] = ffi
+	return ffi, nil
+}
+
+// plannedFileInfo is the file info of a plan file as it was when the plan was made,
+// for reporting on files that can no longer be stat'd.
+type plannedFileInfo struct {
+	file planFile
+}
+
+func (pfi plannedFileInfo) Name() string       { return filepath.Base(pfi.file.Path) }
+func (pfi plannedFileInfo) Size() int64        { return pfi.file.Size }
+func (pfi plannedFileInfo) Mode() fs.FileMode  { return 0 }
+func (pfi plannedFileInfo) ModTime() time.Time { return pfi.file.ModTime }
+func (pfi plannedFileInfo) IsDir() bool        { return false }
+func (pfi plannedFileInfo) Sys() any           { return nil }
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func Test_plan(t *testing.T) {
+	tempDir := t.TempDir()
+	for _, name := range []string{"a", "b", "c", "d"} {
+		if err := os.WriteFile(filepath.Join(tempDir, name), []byte("hello world"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	result, err := findDuplicateFiles(t.Context(), []string{tempDir}, scanOptions{Jobs: 2})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	written, err := newPlan(result)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	planPath := filepath.Join(t.TempDir(), "plan.json")
+	if err := writePlan(planPath, written); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	p, err := readPlan(planPath)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(p.Actions) != 3 {
+		t.Fatalf("Expected=3 actions vs. Actual=%d", len(p.Actions))
+	}
+
+	// change the contents of one target without changing its size or modification time,
+	// and the size of another.
+	changed, grown := p.Actions[0].Target, p.Actions[1].Target
+	if err := os.WriteFile(changed.Path, []byte("hello there"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(changed.Path, time.Now(), changed.ModTime); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(grown.Path, []byte("hello world!"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	checker := newPlanChecker(hasherSHA256, nil)
+	testCases := [...]struct {
+		File     planFile
+		Expected error
+	}{
+		{p.Actions[0].Source, nil},
+		{changed, errPlanPrecondition},
+		{grown, errPlanPrecondition},
+		{p.Actions[2].Target, nil},
+	}
+	for _, tc := range testCases {
+		_, actual := checker.Check(t.Context(), p.Actions[0].Hash, tc.File)
+		if !errors.Is(actual, tc.Expected) {
+			t.Errorf("Input=%s Expected=%v vs. Actual=%v", tc.File.Path, tc.Expected, actual)
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+// hashResult is the checksum of a file as computed by a hashPool.
+type hashResult struct {
+	Checksum string
+	// Full is true if the checksum covers the full contents of the file.
+	Full bool
+}
+
+// hashPool computes checksums of files on a bounded number of workers.
+//
+// Files are submitted as they're found and results are keyed by path, so the order
+// in which the workers finish doesn't matter to callers.
+type hashPool struct {
+	ctx  context.Context
+	hash func(context.Context, fullFileInfo) (hashResult, error)
+	work chan fullFileInfo
+	wg   sync.WaitGroup
+
+	mu      sync.Mutex
+	results map[string]hashResult
+	err     error
+}
+
+// newHashPool starts a pool with a given number of workers.
+//
+// Once the context is cancelled the workers stop picking up new work.
+func newHashPool(ctx context.Context, jobs int, hash func(context.Context, fullFileInfo) (hashResult, error)) *hashPool {
+	if jobs < 1 {
+		jobs = 1
+	}
+	p := &hashPool{
+		ctx:     ctx,
+		hash:    hash,
+		work:    make(chan fullFileInfo, jobs),
+		results: make(map[string]hashResult),
+	}
+	p.wg.Add(jobs)
+	for range jobs {
+		go p.worker()
+	}
+	return p
+}
+
+// Submit queues a file to be hashed, blocking if the workers are busy.
+func (p *hashPool) Submit(ffi fullFileInfo) {
+	p.work <- ffi
+}
+
+// Err returns the first error encountered by any worker, or the context error if it was cancelled.
+func (p *hashPool) Err() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.err != nil {
+		return p.err
+	}
+	return p.ctx.Err()
+}
+
+// Wait stops accepting work, waits for the workers to finish and returns the results.
+func (p *hashPool) Wait() (map[string]hashResult, error) {
+	close(p.work)
+	p.wg.Wait()
+	return p.results, p.Err()
+}
+
+func (p *hashPool) worker() {
+	defer p.wg.Done()
+	for ffi := range p.work {
+		if p.Err() != nil {
+			continue
+		}
+		result, err := p.hash(p.ctx, ffi)
+		p.mu.Lock()
+		if errors.Is(err, errSkipped) {
+			// the file is just left out of the results.
+		} else if err != nil {
+			if p.err == nil {
+				p.err = err
+			}
+		} else {
+			p.results[ffi.Path] = result
+		}
+		p.mu.Unlock()
+	}
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/wcharczuk/space-saver/pkg/filesize"
+	"golang.org/x/sys/unix"
+)
+
+// actionOutcome is what actually happened on disk when we tried to replace a duplicate.
+type actionOutcome int
+
+const (
+	outcomeCloned actionOutcome = iota
+	outcomeAlreadyShared
+	outcomeSkippedCrossDevice
+	outcomeSkippedUnsupported
+	outcomeChangedSinceHash
+	outcomeSkippedUnsafe
+	outcomeFailed
+	outcomeCount // must be last
+)
+
+func (ao actionOutcome) String() string {
+	switch ao {
+	case outcomeCloned:
+		return "cloned"
+	case outcomeAlreadyShared:
+		return "already-shared"
+	case outcomeSkippedCrossDevice:
+		return "skipped-cross-device"
+	case outcomeSkippedUnsupported:
+		return "skipped-unsupported"
+	case outcomeChangedSinceHash:
+		return "changed-since-hash"
+	case outcomeSkippedUnsafe:
+		return "skipped-unsafe"
+	case outcomeFailed:
+		return "failed"
+	default:
+		return fmt.Sprintf("unknown(%d)", int(ao))
+	}
+}
+
+// actionResult is the recorded outcome of a single planned replacement.
+type actionResult struct {
+	Method  string
+	Source  fullFileInfo
+	Target  fullFileInfo
+	Outcome actionOutcome
+	// Bytes are the bytes that are now shared as a result of the action.
+	Bytes  uint64
+	Dedupe *dedupeResult
+	// Metadata is the metadata of the target that couldn't be restored onto its replacement.
+	Metadata []metadataProblem
+	Err      error
+}
+
+// replaceOptions control how duplicates are replaced.
+type replaceOptions struct {
+	Method string
+	// Verify, if true, compares the source and target byte for byte immediately before
+	// replacing the target. It's skipped for the dedupe method, where the kernel does the comparison.
+	Verify bool
+	// ReadOnly, if true, only replaces read-only files with hard links (for the hardlink method).
+	ReadOnly bool
+}
+
+// replaceDuplicate replaces the target with the source and records what actually happened.
+//
+// Both files are re-checked against what was hashed first, and the replacement is skipped
+// if either has changed since.
+func replaceDuplicate(ctx context.Context, opts replaceOptions, source, target fullFileInfo) (result actionResult) {
+	method := opts.Method
+	result = actionResult{Method: method, Source: source, Target: target}
+	sourceInfo, err := os.Stat(source.Path)
+	if err != nil {
+		result.Outcome, result.Err = outcomeFailed, err
+		return
+	}
+	targetInfo, err := os.Stat(target.Path)
+	if err != nil {
+		result.Outcome, result.Err = outcomeFailed, err
+		return
+	}
+	sharing, err := fileSharing(fullFileInfo{Path: source.Path, FileInfo: sourceInfo}, fullFileInfo{Path: target.Path, FileInfo: targetInfo})
+	if err == nil && sharing.Kind() == sharingFull {
+		result.Outcome = outcomeAlreadyShared
+		return
+	}
+	if changedSinceHash(source, sourceInfo) || changedSinceHash(target, targetInfo) {
+		result.Outcome = outcomeChangedSinceHash
+		return
+	}
+	if method == methodHardlink {
+		if err := checkHardlinkSafe(sourceInfo, targetInfo, opts.ReadOnly); err != nil {
+			result.Outcome, result.Err = outcomeSkippedUnsafe, err
+			return
+		}
+	}
+	if opts.Verify && method != methodDedupe {
+		equal, err := filesEqual(ctx, source.Path, target.Path)
+		if err != nil {
+			result.Outcome, result.Err = outcomeFailed, err
+			return
+		}
+		if !equal {
+			result.Outcome, result.Err = outcomeChangedSinceHash, errContentsDiffer
+			return
+		}
+	}
+	switch method {
+	case methodDedupe:
+		dr, err := dedupeFile(source.Path, target.Path)
+		if err != nil {
+			result.Outcome, result.Err = classifyReplaceError(err), err
+			return
+		}
+		result.Dedupe = &dr
+		result.Bytes = dr.BytesDeduped()
+		for _, r := range dr.Ranges {
+			switch r.Status {
+			case dedupeDiffers:
+				result.Outcome = outcomeChangedSinceHash
+				return
+			case dedupeFailed:
+				result.Outcome, result.Err = classifyReplaceError(r.Err), r.Err
+				return
+			}
+		}
+		result.Outcome = outcomeCloned
+	case methodHardlink:
+		if err := hardlinkFile(source.Path, target.Path); err != nil {
+			result.Outcome, result.Err = classifyReplaceError(err), err
+			return
+		}
+		result.Outcome = outcomeCloned
+		result.Bytes = uint64(target.Size())
+	default:
+		problems, err := cloneFile(source.Path, target.Path)
+		result.Metadata = problems
+		if err != nil {
+			result.Outcome, result.Err = classifyReplaceError(err), err
+			return
+		}
+		result.Outcome = outcomeCloned
+		result.Bytes = uint64(target.Size())
+	}
+	return
+}
+
+// changedSinceHash returns if the file on disk no longer matches what we hashed.
+func changedSinceHash(hashed fullFileInfo, current os.FileInfo) bool {
+	return hashed.Size() != current.Size() || !hashed.ModTime().Equal(current.ModTime())
+}
+
+// classifyReplaceError maps errors from the clone or dedupe syscalls onto outcomes.
+func classifyReplaceError(err error) actionOutcome {
+	switch {
+	case errors.Is(err, unix.EXDEV):
+		return outcomeSkippedCrossDevice
+	case errors.Is(err, unix.ENOTSUP), errors.Is(err, unix.EOPNOTSUPP), errors.Is(err, unix.EINVAL):
+		return outcomeSkippedUnsupported
+	default:
+		return outcomeFailed
+	}
+}
+
+// outcomeSummary tallies action results by outcome.
+type outcomeSummary struct {
+	Counts [outcomeCount]int
+	Bytes  [outcomeCount]uint64
+}
+
+// Add records an action result.
+//
+// Bytes are tallied as the bytes actually shared for successful actions
+// and as the target size for everything else.
+func (s *outcomeSummary) Add(result actionResult) {
+	s.Counts[result.Outcome]++
+	if result.Outcome == outcomeCloned {
+		s.Bytes[result.Outcome] += result.Bytes
+	} else {
+		s.Bytes[result.Outcome] += uint64(result.Target.Size())
+	}
+}
+
+// Print writes the per outcome counts and bytes.
+func (s *outcomeSummary) Print(w io.Writer) {
+	fmt.Fprintln(w, "Outcomes:")
+	for outcome := range outcomeCount {
+		fmt.Fprintf(w, "\t%s: %d (%s)\n", outcome, s.Counts[outcome], filesize.FormatFraction(s.Bytes[outcome]))
+	}
+	fmt.Fprintf(w, "Total savings: %s\n", filesize.FormatFraction(s.Bytes[outcomeCloned]))
+}
+
+func printActionResult(w io.Writer, result actionResult) {
+	source, target := truncateStringPrefix(result.Source.Path, 64), truncateStringPrefix(result.Target.Path, 64)
+	if result.Dedupe != nil {
+		printDedupeResult(w, result.Source.Path, result.Target.Path, *result.Dedupe)
+	}
+	switch result.Outcome {
+	case outcomeCloned:
+		switch {
+		case result.Method == methodHardlink:
+			fmt.Fprintf(w, "Hard linked %s to %s\n", source, target)
+		case result.Dedupe == nil:
+			fmt.Fprintf(w, "Cloned %s to %s\n", source, target)
+		}
+		printMetadataProblems(w, result.Metadata)
+	case outcomeFailed:
+		fmt.Fprintf(w, "Failed to %s %s to %s; %v\n", result.Method, source, target, result.Err)
+	default:
+		if result.Err != nil {
+			fmt.Fprintf(w, "Skipped %s to %s (%v); %v\n", source, target, result.Outcome, result.Err)
+			return
+		}
+		fmt.Fprintf(w, "Skipped %s to %s (%v)\n", source, target, result.Outcome)
+	}
+}
+
+// printMetadataProblems writes the metadata that couldn't be restored onto a replacement.
+func printMetadataProblems(w io.Writer, problems []metadataProblem) {
+	for _, problem := range problems {
+		fmt.Fprintf(w, "\tunable to restore %v\n", problem)
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+
+	"github.com/wcharczuk/space-saver/pkg/filesize"
+)
+
+// Orders for the groups of the find report.
+const (
+	sortSavings = "savings"
+	sortSize    = "size"
+	sortCount   = "count"
+	sortPath    = "path"
+)
+
+// sortOrders are the orders for the groups of the find report, in the order they're listed in help.
+var sortOrders = []string{sortSavings, sortSize, sortCount, sortPath}
+
+// sortGroups sorts groups in place by an order: reclaimable bytes, file size or number of files (all descending),
+// or source path. Ties are broken by source path and then checksum so the order is the same from run to run.
+func sortGroups(groups []duplicateGroup, order string) error {
+	var compare func(a, b duplicateGroup) int
+	switch order {
+	case sortSavings:
+		compare = func(a, b duplicateGroup) int { return cmp.Compare(b.Reclaimable(), a.Reclaimable()) }
+	case sortSize:
+		compare = func(a, b duplicateGroup) int { return cmp.Compare(b.Files[0].Size(), a.Files[0].Size()) }
+	case sortCount:
+		compare = func(a, b duplicateGroup) int { return cmp.Compare(len(b.Files), len(a.Files)) }
+	case sortPath:
+		compare = func(a, b duplicateGroup) int { return 0 }
+	default:
+		return fmt.Errorf("unknown sort order %q; must be one of %s", order, strings.Join(sortOrders, ", "))
+	}
+	slices.SortStableFunc(groups, func(a, b duplicateGroup) int {
+		if c := compare(a, b); c != 0 {
+			return c
+		}
+		if c := strings.Compare(a.Files[0].Path, b.Files[0].Path); c != 0 {
+			return c
+		}
+		return strings.Compare(a.Checksum, b.Checksum)
+	})
+	return nil
+}
+
+// printGroupReport writes a block for each group, with the file that's kept and the copies that could be replaced.
+func printGroupReport(w io.Writer, algorithm string, groups []duplicateGroup) {
+	for _, group := range groups {
+		fmt.Fprintf(w, "%s %s (%d files of %s, %s reclaimable)\n", algorithm, group.Checksum, len(group.Files), filesize.Format(uint64(group.Files[0].Size())), filesize.Format(group.Reclaimable()))
+		fmt.Fprintf(w, "\tkeep:    %s\n", group.Files[0].Path)
+		for index, ffi := range group.Files[1:] {
+			sharing := group.Sharing[index+1]
+			switch sharing.Kind() {
+			case sharingFull:
+				fmt.Fprintf(w, "\tshared:  %s\n", ffi.Path)
+			case sharingPartial:
+				fmt.Fprintf(w, "\treplace: %s (%s already shared)\n", ffi.Path, filesize.Format(sharing.SharedBytes))
+			default:
+				fmt.Fprintf(w, "\treplace: %s\n", ffi.Path)
+			}
+		}
+	}
+}
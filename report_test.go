@@ -0,0 +1,55 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func Test_sortGroups(t *testing.T) {
+	newGroup := func(checksum string, size int64, paths ...string) duplicateGroup {
+		group := duplicateGroup{Checksum: checksum}
+		for _, path := range paths {
+			group.Files = append(group.Files, fullFileInfo{Path: path, FileInfo: plannedFileInfo{planFile{Path: path, Size: size}}})
+			group.Sharing = append(group.Sharing, extentSharing{Size: uint64(size)})
+		}
+		return group
+	}
+	groups := []duplicateGroup{
+		newGroup("a", 10, "/b/1", "/b/2", "/b/3"),        // 20 reclaimable
+		newGroup("b", 30, "/a/1", "/a/2"),                // 30 reclaimable
+		newGroup("c", 20, "/c/1", "/c/2"),                // 20 reclaimable
+		newGroup("d", 5, "/d/1", "/d/2", "/d/3", "/d/4"), // 15 reclaimable
+	}
+
+	testCases := [...]struct {
+		Order    string
+		Expected []string
+	}{
+		{sortSavings, []string{"b", "a", "c", "d"}},
+		{sortSize, []string{"b", "c", "a", "d"}},
+		{sortCount, []string{"d", "a", "b", "c"}},
+		{sortPath, []string{"b", "a", "c", "d"}},
+	}
+
+	reversed := slices.Clone(groups)
+	slices.Reverse(reversed)
+
+	for _, tc := range testCases {
+		// the order shouldn't depend on the order the groups were found in.
+		for _, input := range [][]duplicateGroup{slices.Clone(groups), slices.Clone(reversed)} {
+			if err := sortGroups(input, tc.Order); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			var actual []string
+			for _, group := range input {
+				actual = append(actual, group.Checksum)
+			}
+			if !slices.Equal(tc.Expected, actual) {
+				t.Errorf("Input=%s Expected=%v vs. Actual=%v", tc.Order, tc.Expected, actual)
+			}
+		}
+	}
+	if err := sortGroups(groups, "nope"); err == nil {
+		t.Errorf("Input=nope Expected an error")
+	}
+}
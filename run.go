@@ -0,0 +1,205 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// runState is the plan of a real clone-duplicates run, which is saved before any action is taken
+// and removed once they all have been, so that an interrupted run can be resumed.
+//
+// Which actions were finished is recorded in the journal, with an intent entry written before each
+// action and a completion entry after it.
+type runState struct {
+	// ID identifies the run in the journal, it's unique to each run and saved in the run file.
+	ID   string
+	Plan plan
+	// Resumed is set if the run was read from the run file of an interrupted run,
+	// rather than started fresh.
+	Resumed bool
+	path    string
+	// done are the indexes of the actions with a completion entry.
+	done map[int]bool
+	// unfinished are the indexes of the actions with an intent entry but no completion entry,
+	// and the method they were being taken with.
+	unfinished map[int]string
+}
+
+// runFile is the contents of a run file.
+type runFile struct {
+	ID   string `json:"id"`
+	Plan plan   `json:"plan"`
+}
+
+// defaultRunPath returns the path of the run file for a given set of targets (or plan),
+// in the user state directory.
+func defaultRunPath(inputs []string) (string, error) {
+	stateDir, err := defaultStateDir()
+	if err != nil {
+		return "", err
+	}
+	name, err := pathsFileName(inputs)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(stateDir, "runs", name), nil
+}
+
+// newRunState returns the state of a new run of a plan, with a new ID, to be saved at a given path.
+func newRunState(path string, p plan) (*runState, error) {
+	id, err := newRunID()
+	if err != nil {
+		return nil, fmt.Errorf("unable to create run id; %w", err)
+	}
+	return &runState{
+		ID:         id,
+		Plan:       p,
+		path:       path,
+		done:       make(map[int]bool),
+		unfinished: make(map[int]string),
+	}, nil
+}
+
+// openRunState reads the state of an interrupted run, returning nil if there isn't one.
+func openRunState(path string) (*runState, error) {
+	contents, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("run: unable to read %s; %w", path, err)
+	}
+	var rf runFile
+	if err := json.Unmarshal(contents, &rf); err != nil {
+		return nil, fmt.Errorf("run: unable to parse %s; %w", path, err)
+	}
+	if rf.ID == "" || rf.Plan.Version != planVersion {
+		return nil, fmt.Errorf("run: unable to parse %s; unsupported run file (use --fresh to start over)", path)
+	}
+	return &runState{
+		ID:         rf.ID,
+		Plan:       rf.Plan,
+		Resumed:    true,
+		path:       path,
+		done:       make(map[int]bool),
+		unfinished: make(map[int]string),
+	}, nil
+}
+
+// newRunID returns a new run ID, from the time it started and a random nonce.
+func newRunID() (string, error) {
+	nonce := make([]byte, 4)
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	return time.Now().UTC().Format("20060102T150405Z") + "-" + hex.EncodeToString(nonce), nil
+}
+
+// Progress marks which actions were finished (or started) from the entries of the journal.
+func (rs *runState) Progress(entries []journalEntry) {
+	for _, entry := range entries {
+		if entry.Run != rs.ID || entry.Action < 0 || entry.Action >= len(rs.Plan.Actions) {
+			continue
+		}
+		switch entry.State {
+		case journalIntent:
+			rs.unfinished[entry.Action] = entry.Method
+		case journalDone:
+			rs.done[entry.Action] = true
+			delete(rs.unfinished, entry.Action)
+		}
+	}
+}
+
+// Done returns if an action has a completion entry and shouldn't be taken again.
+func (rs *runState) Done(index int) bool {
+	return rs.done[index]
+}
+
+// Repair removes the temporary files of actions that were started but not finished.
+//
+// The target of such an action is either the original file or its replacement (as the temporary file
+// is renamed over it). If it's the replacement the action is returned as finished by its index, and marked
+// as done, otherwise it's safe to take the action again.
+func (rs *runState) Repair() (removed []string, finished map[int]actionResult, err error) {
+	finished = make(map[int]actionResult)
+	removed, err = rs.RemoveTemp()
+	if err != nil {
+		return removed, finished, err
+	}
+	for index, action := range rs.Plan.Actions {
+		method, ok := rs.unfinished[index]
+		if !ok {
+			continue
+		}
+		if result, ok := replacedAlready(method, action); ok {
+			rs.done[index] = true
+			delete(rs.unfinished, index)
+			finished[index] = result
+		}
+	}
+	return removed, finished, nil
+}
+
+// RemoveTemp removes the temporary files of actions that were started but not finished,
+// which is all that's left to do for a run that's started over rather than resumed.
+func (rs *runState) RemoveTemp() (removed []string, err error) {
+	for index, action := range rs.Plan.Actions {
+		if _, ok := rs.unfinished[index]; !ok {
+			continue
+		}
+		paths, err := removeTempSiblings(action.Target.Path)
+		removed = append(removed, paths...)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return removed, fmt.Errorf("unable to repair unfinished action for %s; %w", action.Target.Path, err)
+		}
+	}
+	return removed, nil
+}
+
+// replacedAlready returns if the target of an action already fully shares storage with its source,
+// i.e. if the replacement happened but wasn't recorded.
+func replacedAlready(method string, action planAction) (result actionResult, ok bool) {
+	sourceInfo, err := os.Stat(action.Source.Path)
+	if err != nil {
+		return
+	}
+	targetInfo, err := os.Stat(action.Target.Path)
+	if err != nil {
+		return
+	}
+	source := fullFileInfo{Path: action.Source.Path, FileInfo: sourceInfo}
+	target := fullFileInfo{Path: action.Target.Path, FileInfo: targetInfo}
+	sharing, err := fileSharing(source, target)
+	if err != nil || sharing.Kind() != sharingFull {
+		return
+	}
+	return actionResult{Method: method, Source: source, Target: target, Outcome: outcomeCloned, Bytes: uint64(targetInfo.Size())}, true
+}
+
+// Save writes the run file.
+func (rs *runState) Save() error {
+	contents, err := json.MarshalIndent(runFile{ID: rs.ID, Plan: rs.Plan}, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(rs.path, append(contents, '\n')); err != nil {
+		return fmt.Errorf("run: unable to write %s; %w", rs.path, err)
+	}
+	return nil
+}
+
+// Remove removes the run file once all of its actions have been taken.
+func (rs *runState) Remove() error {
+	if err := os.Remove(rs.path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
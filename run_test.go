@@ -0,0 +1,235 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func Test_runState(t *testing.T) {
+	tempDir := t.TempDir()
+	for _, name := range []string{"a", "b", "c", "d"} {
+		if err := os.WriteFile(filepath.Join(tempDir, name), []byte("hello world"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	result, err := findDuplicateFiles(t.Context(), []string{tempDir}, scanOptions{Jobs: 2})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	p, err := newPlan(result)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(p.Actions) != 3 {
+		t.Fatalf("Expected=3 actions vs. Actual=%d", len(p.Actions))
+	}
+	rs, err := newRunState(filepath.Join(t.TempDir(), "runs", "0123456789abcdef.json"), p)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := rs.Save(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	id := rs.ID
+	rs, err = openRunState(rs.path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if rs == nil || rs.ID != id || !rs.Resumed {
+		t.Fatalf("Expected a resumed run with ID=%s vs. Actual=%v", id, rs)
+	}
+
+	// the first action finished, the second was interrupted after the rename
+	// and the third was interrupted with its temporary file left behind.
+	entries := []journalEntry{
+		{Run: rs.ID, Action: 0, State: journalIntent},
+		{Run: rs.ID, Action: 0, State: journalDone, Outcome: outcomeCloned.String()},
+		{Run: "another-run", Action: 2, State: journalDone},
+		{Run: rs.ID, Action: 1, State: journalIntent, Method: methodHardlink},
+		{Run: rs.ID, Action: 2, State: journalIntent, Method: methodHardlink},
+	}
+	if err := hardlinkFile(p.Actions[1].Source.Path, p.Actions[1].Target.Path); err != nil {
+		t.Fatal(err)
+	}
+	tempPath, err := tempSiblingPath(p.Actions[2].Target.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(tempPath, []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	rs.Progress(entries)
+	removed, finished, err := rs.Repair()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(removed) != 1 || removed[0] != tempPath {
+		t.Errorf("Expected removed=[%s] vs. Actual=%v", tempPath, removed)
+	}
+	if _, ok := finished[1]; !ok || len(finished) != 1 {
+		t.Errorf("Expected finished=[1] vs. Actual=%v", finished)
+	}
+	testCases := [...]struct {
+		Input    int
+		Expected bool
+	}{
+		{0, true},
+		{1, true},
+		{2, false},
+	}
+	for _, tc := range testCases {
+		if actual := rs.Done(tc.Input); actual != tc.Expected {
+			t.Errorf("Input=%d Expected=%v vs. Actual=%v", tc.Input, tc.Expected, actual)
+		}
+	}
+
+	if err := rs.Remove(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if rs, err := openRunState(rs.path); err != nil || rs != nil {
+		t.Errorf("Expected no run vs. Actual=%v (%v)", rs, err)
+	}
+}
+
+func Test_newRunState_unique(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "runs", "0123456789abcdef.json")
+	first, err := newRunState(path, plan{Version: planVersion})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	second, err := newRunState(path, plan{Version: planVersion})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if first.ID == second.ID {
+		t.Errorf("Expected unique run IDs vs. Actual=%s and %s", first.ID, second.ID)
+	}
+	if first.Resumed || second.Resumed {
+		t.Errorf("Expected new runs not to be resumed")
+	}
+}
+
+func Test_cloneDuplicates_twice(t *testing.T) {
+	t.Setenv("XDG_STATE_HOME", t.TempDir())
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+	tempDir := t.TempDir()
+	journalPath := filepath.Join(t.TempDir(), "journal.jsonl")
+	run := func(names ...string) {
+		t.Helper()
+		for _, name := range names {
+			if err := os.WriteFile(filepath.Join(tempDir, name), []byte("hello "+names[0]), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		args := []string{"space-saver", "clone-duplicates", "--real", "--method=hardlink", "--no-cache", "--min-size=0", "--journal", journalPath, tempDir}
+		if err := commandRoot.Run(t.Context(), args); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		first, err := os.Stat(filepath.Join(tempDir, names[0]))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, name := range names[1:] {
+			info, err := os.Stat(filepath.Join(tempDir, name))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !os.SameFile(first, info) {
+				t.Errorf("Input=%s Expected=replaced vs. Actual=not replaced", name)
+			}
+		}
+	}
+
+	// the second run is of the same targets, and must not skip its actions
+	// because of the completions recorded by the first.
+	run("a1", "a2")
+	if err := os.Remove(filepath.Join(tempDir, "a1")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(filepath.Join(tempDir, "a2")); err != nil {
+		t.Fatal(err)
+	}
+	run("b1", "b2")
+}
+
+func Test_cloneDuplicates_fresh(t *testing.T) {
+	t.Setenv("XDG_STATE_HOME", t.TempDir())
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+	tempDir := t.TempDir()
+	journalPath := filepath.Join(t.TempDir(), "journal.jsonl")
+	for _, name := range []string{"a1", "a2"} {
+		if err := os.WriteFile(filepath.Join(tempDir, name), []byte("hello world"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	runPath, err := defaultRunPath([]string{tempDir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	args := []string{"space-saver", "clone-duplicates", "--real", "--method=hardlink", "--no-cache", "--min-size=0", "--journal", journalPath}
+
+	// a run file that can't be read can only be started over.
+	if err := os.MkdirAll(filepath.Dir(runPath), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(runPath, []byte("{"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := commandRoot.Run(t.Context(), append(args, tempDir)); err == nil {
+		t.Errorf("Expected an error for an unreadable run file without --fresh vs. Actual=nil")
+	}
+	if err := commandRoot.Run(t.Context(), append(args, "--fresh", tempDir)); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if rs, err := openRunState(runPath); err != nil || rs != nil {
+		t.Errorf("Expected the run file to be replaced and removed vs. Actual=%v (%v)", rs, err)
+	}
+
+	// an interrupted run that left a temporary file behind.
+	if err := os.Remove(filepath.Join(tempDir, "a2")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(tempDir, "a2"), []byte("hello world"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	result, err := findDuplicateFiles(t.Context(), []string{tempDir}, scanOptions{Jobs: 2})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	p, err := newPlan(result)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	rs, err := newRunState(runPath, p)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := rs.Save(); err != nil {
+		t.Fatal(err)
+	}
+	j, err := openJournal(journalPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := j.Intend(rs.ID, 0, methodClone, p.Algorithm, p.Actions[0]); err != nil {
+		t.Fatal(err)
+	}
+	if err := j.Close(); err != nil {
+		t.Fatal(err)
+	}
+	tempPath, err := tempSiblingPath(p.Actions[0].Target.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(tempPath, []byte("hello world"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := commandRoot.Run(t.Context(), append(args, "--fresh", tempDir)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := os.Stat(tempPath); !os.IsNotExist(err) {
+		t.Errorf("Expected %s to be removed vs. Actual=%v", tempPath, err)
+	}
+}
@@ -0,0 +1,650 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// sampleSize is the number of bytes read from both the head and the tail
+// of a file when computing its sample checksum.
+const sampleSize = 64 << 10
+
+// scanOptions are the options that control how we search for duplicates.
+type scanOptions struct {
+	MinSizeBytes uint64
+	// Jobs is the number of files to hash concurrently.
+	Jobs int
+	// Hasher is the algorithm used for full checksums, it defaults to sha256.
+	Hasher hasher
+	// SampleHasher is the algorithm used for sample checksums, it defaults to crc64.
+	SampleHasher hasher
+	// Cache, if set, is consulted before and updated after computing checksums.
+	Cache *hashCache
+	// Include, if set, are patterns that files must match at least one of to be considered.
+	Include []string
+	// Exclude are patterns for files and directories to skip.
+	Exclude []string
+	// KeepGoing, if true, records errors reading or hashing individual paths and carries on
+	// without them rather than failing the scan.
+	KeepGoing bool
+	// Keep is the policy for which file of a group is kept as the source of the others.
+	Keep keepPolicy
+	// Prefer are directories whose files are kept over any others regardless of the keep policy,
+	// in order of preference.
+	Prefer []string
+	// FollowSymlinks, if true, walks into symlinked directories and considers symlinked files
+	// by their resolved path, otherwise symlinks are skipped.
+	FollowSymlinks bool
+	// OneFileSystem, if true, stops the walk from descending into directories on other devices than their root.
+	OneFileSystem bool
+	// Checkpoint, if set, records every checksum of this scan and is saved if the scan
+	// is interrupted so that it can be resumed; it's removed once the scan completes.
+	Checkpoint *hashCache
+}
+
+// caches returns the caches to consult for checksums, in order.
+func (opts scanOptions) caches() (caches []*hashCache) {
+	if opts.Checkpoint != nil {
+		caches = append(caches, opts.Checkpoint)
+	}
+	if opts.Cache != nil {
+		caches = append(caches, opts.Cache)
+	}
+	return
+}
+
+// findDuplicateFiles finds files with identical contents under a given set of root paths.
+//
+// Every root is scanned into a single index, so duplicates are found across roots as well as within them.
+// Roots that are repeated or nested within another root are only scanned once.
+//
+// The search is done in stages so that we only read as much of each file as we need to:
+//   - files are grouped by exact size, files with a unique size can't have a duplicate.
+//   - files that share a size are grouped by a checksum of a sample of their head and tail.
+//   - files that share a sample checksum are grouped by a checksum of their full contents.
+//
+// Sample checksums are computed by a pool of workers fed by the walk as soon as a size is seen twice.
+// Groups are assembled in walk order once all the checksums are in, so the results don't depend on
+// the order in which the workers finish.
+//
+// Identical files are grouped by device, as clones can only share extents within a filesystem.
+// Files that are identical across devices are returned separately, as they can't be cloned.
+func findDuplicateFiles(ctx context.Context, roots []string, opts scanOptions) (result scanResult, err error) {
+	if opts.Cache != nil {
+		defer func() {
+			if saveErr := opts.Cache.Save(); saveErr != nil && err == nil {
+				err = saveErr
+			}
+		}()
+	}
+	if opts.Checkpoint != nil {
+		defer func() {
+			if err == nil {
+				err = opts.Checkpoint.Remove()
+				return
+			}
+			// resuming a scan that failed for any other reason would just fail again.
+			if !errors.Is(err, context.Canceled) && ctx.Err() == nil {
+				return
+			}
+			if saveErr := opts.Checkpoint.Save(); saveErr != nil {
+				err = fmt.Errorf("%w; unable to save checkpoint: %v", err, saveErr)
+				return
+			}
+			err = fmt.Errorf("%w; checkpoint saved to %s, use --resume to continue", err, opts.Checkpoint.path)
+		}()
+	}
+	roots, err = normalizeRoots(roots)
+	if err != nil {
+		return
+	}
+	if opts.Hasher == nil {
+		opts.Hasher = hasherSHA256
+	}
+	if opts.SampleHasher == nil {
+		opts.SampleHasher = hasherCRC64
+	}
+	result.Algorithm = opts.Hasher.Name()
+	selector := sourceSelector{Policy: opts.Keep}
+	for _, dir := range opts.Prefer {
+		var abs string
+		abs, err = filepath.Abs(dir)
+		if err != nil {
+			return
+		}
+		selector.Prefer = append(selector.Prefer, abs)
+	}
+	caches := opts.caches()
+	s := &scanner{
+		opts:    opts,
+		bySize:  make(map[int64][]fullFileInfo),
+		visited: make(map[[2]uint64]bool),
+	}
+	s.samplePool = newHashPool(ctx, opts.Jobs, s.keepGoing(func(ctx context.Context, ffi fullFileInfo) (hashResult, error) {
+		// if the sample would cover the whole file, just take the full checksum.
+		if ffi.Size() <= 2*sampleSize {
+			cs, err := cachedChecksum(caches, ffi, opts.Hasher.Name(), func() (string, error) {
+				return checksumFile(ctx, opts.Hasher, ffi.Path)
+			})
+			return hashResult{Checksum: cs, Full: true}, err
+		}
+		cs, err := cachedChecksum(caches, ffi, sampleCacheName(opts.SampleHasher), func() (string, error) {
+			return sampleChecksumFile(ctx, opts.SampleHasher, ffi.Path, ffi.Size())
+		})
+		return hashResult{Checksum: cs}, err
+	}))
+	var walkErr error
+	for index, root := range roots {
+		s.root = index
+		if walkErr = s.walk(root); walkErr != nil {
+			break
+		}
+	}
+	samples, err := s.samplePool.Wait()
+	if walkErr != nil {
+		err = walkErr
+		return
+	}
+	if err != nil {
+		return
+	}
+
+	fullPool := newHashPool(ctx, opts.Jobs, s.keepGoing(func(ctx context.Context, ffi fullFileInfo) (hashResult, error) {
+		cs, err := cachedChecksum(caches, ffi, opts.Hasher.Name(), func() (string, error) {
+			return checksumFile(ctx, opts.Hasher, ffi.Path)
+		})
+		return hashResult{Checksum: cs, Full: true}, err
+	}))
+	for _, size := range s.sizes {
+		for _, sampleGroup := range groupBySample(s.bySize[size], samples) {
+			for _, ffi := range sampleGroup {
+				if !samples[ffi.Path].Full {
+					fullPool.Submit(ffi)
+				}
+			}
+		}
+	}
+	fulls, err := fullPool.Wait()
+	if err != nil {
+		return
+	}
+	result.Errors = s.errors
+	result.Special = s.special
+	sortScanErrors(result.Errors)
+
+	for _, size := range s.sizes {
+		for _, sampleGroup := range groupBySample(s.bySize[size], samples) {
+			fullChecksum := func(ffi fullFileInfo) string {
+				if sample := samples[ffi.Path]; sample.Full {
+					return sample.Checksum
+				}
+				return fulls[ffi.Path].Checksum
+			}
+			// files whose full checksum failed are left out.
+			sampleGroup = slices.DeleteFunc(slices.Clone(sampleGroup), func(ffi fullFileInfo) bool {
+				return fullChecksum(ffi) == ""
+			})
+			for _, fullGroup := range groupFiles(sampleGroup, fullChecksum) {
+				if len(fullGroup) < 2 {
+					continue
+				}
+				cs := fullChecksum(fullGroup[0])
+				crossDevice := duplicateGroup{Checksum: cs}
+				deviceGroups := groupFiles(fullGroup, func(ffi fullFileInfo) string {
+					return strconv.FormatUint(ffi.Device(), 10)
+				})
+				for _, deviceGroup := range deviceGroups {
+					group := duplicateGroup{Checksum: cs, Device: deviceGroup[0].Device(), Files: deviceGroup}
+					slices.SortFunc(group.Files, selector.Compare)
+					if len(group.Files) > 1 {
+						group.computeSharing()
+						result.Groups = append(result.Groups, group)
+					}
+					crossDevice.Files = append(crossDevice.Files, group.Files[0])
+				}
+				slices.SortFunc(crossDevice.Files, selector.Compare)
+				if len(deviceGroups) > 1 {
+					result.CrossDevice = append(result.CrossDevice, crossDevice)
+				}
+			}
+		}
+	}
+	return
+}
+
+// scanResult are the duplicates found by findDuplicateFiles.
+type scanResult struct {
+	// Algorithm is the name of the hash algorithm of the group checksums.
+	Algorithm string
+	// Groups are sets of identical files on the same device.
+	Groups []duplicateGroup
+	// CrossDevice are sets of identical files that can't be cloned because they're on different devices.
+	// Each set holds the file that would be kept from each device (i.e. the source of that device's group, if it has one).
+	CrossDevice []duplicateGroup
+	// Errors are the paths that were skipped because of errors, sorted by path.
+	Errors []scanError
+	// Special are the number of non-regular files that were skipped by kind.
+	Special specialCounts
+}
+
+// duplicateGroup is a set of files with identical contents, sorted so that the file to keep is first.
+type duplicateGroup struct {
+	Checksum string
+	// Device is the device all the files are on, it is unset for cross device groups.
+	Device uint64
+	Files  []fullFileInfo
+	// Sharing is how much of each file already shares storage with the first file.
+	Sharing []extentSharing
+}
+
+// computeSharing inspects the extents of each file against the first file.
+//
+// Files whose extents can't be inspected are treated as unshared.
+func (g *duplicateGroup) computeSharing() {
+	g.Sharing = make([]extentSharing, len(g.Files))
+	for index, ffi := range g.Files {
+		if index == 0 {
+			g.Sharing[index] = extentSharing{Size: uint64(ffi.Size()), SharedBytes: uint64(ffi.Size())}
+			continue
+		}
+		sharing, err := fileSharing(g.Files[0], ffi)
+		if err != nil {
+			sharing = extentSharing{Size: uint64(ffi.Size())}
+		}
+		g.Sharing[index] = sharing
+	}
+}
+
+// Reclaimable returns the bytes that could be saved by sharing every file with the first file.
+func (g duplicateGroup) Reclaimable() (total uint64) {
+	for _, sharing := range g.Sharing[1:] {
+		total += sharing.Reclaimable()
+	}
+	return
+}
+
+// scanner holds the state of the walk stage of findDuplicateFiles.
+type scanner struct {
+	opts       scanOptions
+	samplePool *hashPool
+	// root is the index of the root being walked.
+	root int
+	// sizes are the distinct sizes seen, in the order they were first seen.
+	sizes  []int64
+	bySize map[int64][]fullFileInfo
+	// visited are the directories that have been walked, by device and inode,
+	// so that following symlinks doesn't walk a directory twice (or forever).
+	visited map[[2]uint64]bool
+	special specialCounts
+
+	mu     sync.Mutex
+	errors []scanError
+}
+
+// skip records that a path was skipped because of an error if we're keeping going,
+// otherwise it returns the error.
+func (s *scanner) skip(path string, size int64, err error) error {
+	if !s.opts.KeepGoing {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.errors = append(s.errors, scanError{Path: path, Category: categorizeError(err), Bytes: uint64(max(size, 0)), Err: err})
+	return nil
+}
+
+// keepGoing wraps a hash function so that, if we're keeping going, errors hashing a file are
+// recorded and the file is left out of the results rather than failing the scan.
+func (s *scanner) keepGoing(hash func(context.Context, fullFileInfo) (hashResult, error)) func(context.Context, fullFileInfo) (hashResult, error) {
+	return func(ctx context.Context, ffi fullFileInfo) (hashResult, error) {
+		result, err := hash(ctx, ffi)
+		if err == nil || ctx.Err() != nil {
+			return result, err
+		}
+		if err := s.skip(ffi.Path, ffi.Size(), err); err != nil {
+			return result, err
+		}
+		return result, errSkipped
+	}
+}
+
+// walk adds the files under a root to the size buckets, submitting them
+// to the sample pool once their size has been seen more than once.
+func (s *scanner) walk(root string) error {
+	filter := newWalkFilter(root, s.opts.Include, s.opts.Exclude)
+	rootInfo, err := os.Stat(root)
+	if err != nil {
+		return err
+	}
+	rootDevice := fullFileInfo{FileInfo: rootInfo}.Device()
+	if rootInfo.IsDir() {
+		// a root that is itself a symlink is always followed, as it was asked for explicitly.
+		root = followPath(root)
+	}
+	return s.walkDir(root, filter, rootDevice)
+}
+
+// walkDir walks a directory, which may be a symlinked directory that's being followed.
+func (s *scanner) walkDir(dir string, filter *walkFilter, rootDevice uint64) error {
+	return filepath.Walk(dir, filepath.WalkFunc(func(path string, info fs.FileInfo, err error) error {
+		if err := s.samplePool.Err(); err != nil {
+			return err
+		}
+		if err != nil {
+			// a directory we can't read is passed to us again with an error,
+			// returning nil carries on without its contents.
+			var size int64
+			if info != nil && !info.IsDir() {
+				size = info.Size()
+			}
+			return s.skip(path, size, err)
+		}
+		if info.IsDir() {
+			if s.opts.OneFileSystem && (fullFileInfo{FileInfo: info}).Device() != rootDevice {
+				return filepath.SkipDir
+			}
+			if st, ok := statOf(info); ok {
+				if s.visited[[2]uint64{st.Dev, st.Ino}] {
+					return filepath.SkipDir
+				}
+				s.visited[[2]uint64{st.Dev, st.Ino}] = true
+			}
+			skip, err := filter.SkipDir(path)
+			if err != nil {
+				// without its ignore rules the directory can't be walked safely, so it's skipped entirely.
+				if err := s.skip(path, 0, err); err != nil {
+					return err
+				}
+				return filepath.SkipDir
+			}
+			if skip {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if filter.SkipFile(path) {
+			return nil
+		}
+		if strings.HasSuffix(info.Name(), tempSuffix) {
+			// a temporary file left by an interrupted replacement isn't a duplicate to keep.
+			return nil
+		}
+		if info.Mode()&fs.ModeSymlink != 0 && s.opts.FollowSymlinks {
+			return s.followSymlink(path, filter, rootDevice)
+		}
+		if !info.Mode().IsRegular() {
+			s.special[specialKindOf(info.Mode())]++
+			return nil
+		}
+		s.add(path, info)
+		return nil
+	}))
+}
+
+// followSymlink walks a symlinked directory or adds a symlinked file by its resolved path.
+//
+// Symlinked files are added by their resolved path so that replacing them replaces
+// the file and not the symlink.
+func (s *scanner) followSymlink(path string, filter *walkFilter, rootDevice uint64) error {
+	info, err := os.Stat(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		// a dangling link is just a special file, there's nothing there to read.
+		s.special[specialBrokenSymlink]++
+		return nil
+	}
+	if err != nil {
+		return s.skip(path, 0, err)
+	}
+	if info.IsDir() {
+		if st, ok := statOf(info); ok && s.visited[[2]uint64{st.Dev, st.Ino}] {
+			s.special[specialRepeatedDir]++
+			return nil
+		}
+		return s.walkDir(followPath(path), filter, rootDevice)
+	}
+	if !info.Mode().IsRegular() {
+		s.special[specialKindOf(info.Mode())]++
+		return nil
+	}
+	resolved, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return s.skip(path, 0, err)
+	}
+	s.add(resolved, info)
+	return nil
+}
+
+// add adds a regular file to its size bucket, unless it's a hard link to (or the same path as)
+// a file that's already been added.
+func (s *scanner) add(path string, info fs.FileInfo) {
+	if uint64(info.Size()) < s.opts.MinSizeBytes {
+		return
+	}
+	for _, existing := range s.bySize[info.Size()] {
+		if os.SameFile(info, existing.FileInfo) {
+			return
+		}
+	}
+	if _, ok := s.bySize[info.Size()]; !ok {
+		s.sizes = append(s.sizes, info.Size())
+	}
+	bucket := append(s.bySize[info.Size()], fullFileInfo{Path: path, FileInfo: info, Root: s.root})
+	s.bySize[info.Size()] = bucket
+	switch {
+	case len(bucket) == 2:
+		s.samplePool.Submit(bucket[0])
+		s.samplePool.Submit(bucket[1])
+	case len(bucket) > 2:
+		s.samplePool.Submit(bucket[len(bucket)-1])
+	}
+}
+
+// followPath returns a path for a directory that, if it's a symlink, makes filepath.Walk
+// walk the directory it points to rather than just visiting the symlink.
+//
+// The paths of the files beneath it are still joined onto the path as given.
+func followPath(dir string) string {
+	if strings.HasSuffix(dir, string(filepath.Separator)) {
+		return dir
+	}
+	return dir + string(filepath.Separator)
+}
+
+// normalizeRoots cleans a list of roots and removes any that are repeated or nested within another root,
+// preserving the order of the roots that remain.
+//
+// Roots are compared by their absolute path with symlinks resolved, but the cleaned path as given is what's walked.
+func normalizeRoots(roots []string) (normalized []string, err error) {
+	resolved := make([]string, len(roots))
+	for index, root := range roots {
+		var abs string
+		abs, err = filepath.Abs(root)
+		if err != nil {
+			return
+		}
+		resolved[index], err = filepath.EvalSymlinks(abs)
+		if err != nil {
+			return
+		}
+	}
+	for index, root := range roots {
+		var skip bool
+		for otherIndex, other := range resolved {
+			if otherIndex == index {
+				continue
+			}
+			if resolved[index] == other {
+				// repeated roots; keep the first one.
+				skip = otherIndex < index
+			} else {
+				skip = isWithin(resolved[index], other)
+			}
+			if skip {
+				break
+			}
+		}
+		if !skip {
+			normalized = append(normalized, filepath.Clean(root))
+		}
+	}
+	return
+}
+
+// isWithin returns if a path is within (and not equal to) a given directory.
+func isWithin(path, dir string) bool {
+	rel, err := filepath.Rel(dir, path)
+	if err != nil {
+		return false
+	}
+	return rel != "." && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// groupBySample returns the groups of (2 or more) files in a size bucket that share a sample checksum.
+//
+// Files without a sample checksum (i.e. that were skipped because of an error) are left out.
+func groupBySample(bucket []fullFileInfo, samples map[string]hashResult) (groups [][]fullFileInfo) {
+	if len(bucket) < 2 {
+		return
+	}
+	bucket = slices.DeleteFunc(slices.Clone(bucket), func(ffi fullFileInfo) bool {
+		_, ok := samples[ffi.Path]
+		return !ok
+	})
+	for _, group := range groupFiles(bucket, func(ffi fullFileInfo) string { return samples[ffi.Path].Checksum }) {
+		if len(group) > 1 {
+			groups = append(groups, group)
+		}
+	}
+	return
+}
+
+// groupFiles groups files by a key, preserving the order in which each group was first seen
+// and the order of the files within each group.
+func groupFiles(files []fullFileInfo, key func(fullFileInfo) string) (groups [][]fullFileInfo) {
+	indexes := make(map[string]int)
+	for _, ffi := range files {
+		k := key(ffi)
+		index, ok := indexes[k]
+		if !ok {
+			index = len(groups)
+			indexes[k] = index
+			groups = append(groups, nil)
+		}
+		groups[index] = append(groups[index], ffi)
+	}
+	return
+}
+
+type fullFileInfo struct {
+	fs.FileInfo
+	Path string
+	// Root is the index of the (normalized) root the file was found under.
+	Root int
+}
+
+// Device returns the device the file is on.
+func (ffi fullFileInfo) Device() uint64 {
+	st, _ := statOf(ffi.FileInfo)
+	return st.Dev
+}
+
+func compareModTime(a, b fullFileInfo) int {
+	if a.ModTime().Before(b.ModTime()) {
+		return -1
+	}
+	if a.ModTime().Equal(b.ModTime()) {
+		return 0
+	}
+	return 1
+}
+
+// checksumFile returns the checksum of the full contents of a file.
+func checksumFile(ctx context.Context, hasher hasher, path string) (checksum string, err error) {
+	var f *os.File
+	f, err = openRegular(path)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	h := hasher.New()
+	if _, err = io.Copy(h, contextReader{ctx, f}); err != nil {
+		return
+	}
+	checksum = hex.EncodeToString(h.Sum(nil))
+	return
+}
+
+// cachedChecksum returns a checksum from the first cache that has it, adding it to all of the others
+// (e.g. so that checksums from a checkpoint reach the persistent cache). If none of the caches have it,
+// it's computed and added to all of them.
+func cachedChecksum(caches []*hashCache, ffi fullFileInfo, algorithm string, compute func() (string, error)) (string, error) {
+	for _, cache := range caches {
+		if cs, ok := cache.Get(ffi, algorithm); ok {
+			for _, other := range caches {
+				if other != cache {
+					other.Put(ffi, algorithm, cs)
+				}
+			}
+			return cs, nil
+		}
+	}
+	cs, err := compute()
+	if err != nil {
+		return "", err
+	}
+	for _, cache := range caches {
+		cache.Put(ffi, algorithm, cs)
+	}
+	return cs, nil
+}
+
+// sampleCacheName is the name sample checksums are cached under, which is distinct
+// from the name of full checksums computed with the same algorithm.
+func sampleCacheName(hasher hasher) string {
+	return "sample-" + hasher.Name()
+}
+
+// sampleChecksumFile returns a checksum of the head and tail of a file.
+func sampleChecksumFile(ctx context.Context, hasher hasher, path string, size int64) (checksum string, err error) {
+	if err = ctx.Err(); err != nil {
+		return
+	}
+	var f *os.File
+	f, err = openRegular(path)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	h := hasher.New()
+	if _, err = io.Copy(h, io.NewSectionReader(f, 0, sampleSize)); err != nil {
+		return
+	}
+	if _, err = io.Copy(h, io.NewSectionReader(f, size-sampleSize, sampleSize)); err != nil {
+		return
+	}
+	checksum = hex.EncodeToString(h.Sum(nil))
+	return
+}
+
+// contextReader stops reading once its context is cancelled.
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (cr contextReader) Read(p []byte) (int, error) {
+	if err := cr.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return cr.r.Read(p)
+}
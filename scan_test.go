@@ -0,0 +1,298 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"hash"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func Test_findDuplicateFiles(t *testing.T) {
+	tempDir := t.TempDir()
+	big := bytes.Repeat([]byte("0123456789abcdef"), (4*sampleSize)/16)
+	bigMiddleChanged := bytes.Clone(big)
+	bigMiddleChanged[len(big)/2] = 'x'
+
+	files := map[string][]byte{
+		"big":               big,
+		"a/big-copy":        big,
+		"a/big-middle":      bigMiddleChanged,
+		"small":             []byte("hello world"),
+		"b/small-copy":      []byte("hello world"),
+		"b/small-different": []byte("hello there"),
+		"unique":            []byte("unique"),
+
+		// left by an interrupted replacement, so it isn't a duplicate.
+		"b/.small-copy.0123456789ab" + tempSuffix: []byte("hello world"),
+	}
+	for name, contents := range files {
+		path := filepath.Join(tempDir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, contents, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	result, err := findDuplicateFiles(t.Context(), []string{tempDir}, scanOptions{Jobs: 4})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(result.Groups) != 2 {
+		t.Fatalf("Expected=2 groups vs. Actual=%d", len(result.Groups))
+	}
+	if len(result.CrossDevice) != 0 {
+		t.Errorf("Expected=0 cross device groups vs. Actual=%d", len(result.CrossDevice))
+	}
+	for _, group := range result.Groups {
+		if len(group.Files) != 2 {
+			t.Errorf("Hash=%s Expected=2 files vs. Actual=%d", group.Checksum, len(group.Files))
+		}
+		for _, ffi := range group.Files {
+			if ffi.Device() != group.Device {
+				t.Errorf("Path=%s Expected device=%d vs. Actual=%d", ffi.Path, group.Device, ffi.Device())
+			}
+			actual, err := checksumFile(t.Context(), hasherSHA256, ffi.Path)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if actual != group.Checksum {
+				t.Errorf("Path=%s Expected=%s vs. Actual=%s", ffi.Path, group.Checksum, actual)
+			}
+		}
+	}
+}
+
+func Test_findDuplicateFiles_unreadableIgnoreFile(t *testing.T) {
+	tempDir := t.TempDir()
+	for _, name := range []string{"small", "a/small-copy", "a/small-ignored"} {
+		path := filepath.Join(tempDir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte("hello world"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// a directory can't be read as an ignore file, whoever we're running as.
+	if err := os.Mkdir(filepath.Join(tempDir, "a", ignoreFileName), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := findDuplicateFiles(t.Context(), []string{tempDir}, scanOptions{Jobs: 2, KeepGoing: true})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(result.Errors) != 1 || result.Errors[0].Path != filepath.Join(tempDir, "a") {
+		t.Errorf("Expected=1 error for %s vs. Actual=%v", filepath.Join(tempDir, "a"), result.Errors)
+	}
+	if len(result.Groups) != 0 {
+		t.Errorf("Expected=0 groups vs. Actual=%d", len(result.Groups))
+	}
+
+	// the scan would fail the same way again, so there's no checkpoint to resume from.
+	checkpointPath := filepath.Join(t.TempDir(), "checkpoint.json")
+	_, err = findDuplicateFiles(t.Context(), []string{tempDir}, scanOptions{Jobs: 2, Checkpoint: newHashCache(checkpointPath)})
+	if err == nil || strings.Contains(err.Error(), "--resume") {
+		t.Errorf("Expected an error without keep going or checkpoint vs. Actual=%v", err)
+	}
+	if _, err := os.Stat(checkpointPath); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Expected no checkpoint vs. Actual=%v", err)
+	}
+}
+
+func Test_findDuplicateFiles_symlinks(t *testing.T) {
+	tempDir, outside := t.TempDir(), t.TempDir()
+	for _, path := range []string{
+		filepath.Join(tempDir, "a"),
+		filepath.Join(tempDir, "dir", "b"),
+		filepath.Join(outside, "c"),
+	} {
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte("hello world"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	symlinks := map[string]string{
+		"outside":      outside,
+		"dir/up":       "..",
+		"a-link":       "a",
+		"outside-file": filepath.Join(outside, "c"),
+		"loop":         "loop",
+		"dangling":     "missing",
+	}
+	for name, target := range symlinks {
+		if err := os.Symlink(target, filepath.Join(tempDir, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// reading a named pipe with no writer would block the scan forever.
+	if err := unix.Mkfifo(filepath.Join(tempDir, "fifo"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := [...]struct {
+		FollowSymlinks   bool
+		ExpectedFiles    []string
+		ExpectedSymlinks int
+		ExpectedRepeated int
+		ExpectedBroken   int
+		ExpectedErrors   int
+	}{
+		{false, []string{"a", "dir/b"}, len(symlinks), 0, 0, 0},
+		// "up" leads back to the root and "a-link" and "outside-file" resolve to files we've seen,
+		// "loop" can't be resolved and "dangling" is counted rather than being an error.
+		{true, []string{"a", "dir/b", "outside/c"}, 0, 1, 1, 1},
+	}
+
+	for _, tc := range testCases {
+		result, err := findDuplicateFiles(t.Context(), []string{tempDir}, scanOptions{Jobs: 2, KeepGoing: true, FollowSymlinks: tc.FollowSymlinks})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		var actual []string
+		for _, group := range result.Groups {
+			for _, ffi := range group.Files {
+				rel, _ := filepath.Rel(tempDir, ffi.Path)
+				actual = append(actual, filepath.ToSlash(rel))
+			}
+		}
+		slices.Sort(actual)
+		if !slices.Equal(tc.ExpectedFiles, actual) {
+			t.Errorf("Input=%v Expected=%v vs. Actual=%v", tc.FollowSymlinks, tc.ExpectedFiles, actual)
+		}
+		if actual := result.Special[specialSymlink]; actual != tc.ExpectedSymlinks {
+			t.Errorf("Input=%v Expected symlinks=%d vs. Actual=%d", tc.FollowSymlinks, tc.ExpectedSymlinks, actual)
+		}
+		if actual := result.Special[specialNamedPipe]; actual != 1 {
+			t.Errorf("Input=%v Expected named pipes=1 vs. Actual=%d", tc.FollowSymlinks, actual)
+		}
+		if actual := result.Special[specialRepeatedDir]; actual != tc.ExpectedRepeated {
+			t.Errorf("Input=%v Expected repeated=%d vs. Actual=%d", tc.FollowSymlinks, tc.ExpectedRepeated, actual)
+		}
+		if actual := result.Special[specialBrokenSymlink]; actual != tc.ExpectedBroken {
+			t.Errorf("Input=%v Expected broken=%d vs. Actual=%d", tc.FollowSymlinks, tc.ExpectedBroken, actual)
+		}
+		if actual := len(result.Errors); actual != tc.ExpectedErrors {
+			t.Errorf("Input=%v Expected errors=%d vs. Actual=%d", tc.FollowSymlinks, tc.ExpectedErrors, actual)
+		}
+	}
+}
+
+// cancellingHasher is sha256, but cancels a scan once a given number of checksums have been started.
+type cancellingHasher struct {
+	cancel  context.CancelFunc
+	after   int32
+	started *atomic.Int32
+}
+
+func (ch cancellingHasher) Name() string { return hasherSHA256.Name() }
+func (ch cancellingHasher) New() hash.Hash {
+	if ch.started.Add(1) > ch.after {
+		ch.cancel()
+	}
+	return hasherSHA256.New()
+}
+
+func Test_findDuplicateFiles_resume(t *testing.T) {
+	tempDir := t.TempDir()
+	for index := range 8 {
+		for _, name := range []string{"a", "b"} {
+			contents := fmt.Sprintf("contents %d", index)
+			if err := os.WriteFile(filepath.Join(tempDir, fmt.Sprintf("%s%d", name, index)), []byte(contents), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	checkpointPath := filepath.Join(t.TempDir(), "checkpoint.json")
+
+	ctx, cancel := context.WithCancel(t.Context())
+	defer cancel()
+	hasher := cancellingHasher{cancel: cancel, after: 4, started: new(atomic.Int32)}
+	_, err := findDuplicateFiles(ctx, []string{tempDir}, scanOptions{Jobs: 1, Hasher: hasher, Checkpoint: newHashCache(checkpointPath)})
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("Expected=%v vs. Actual=%v", context.Canceled, err)
+	}
+	checkpoint, err := openHashCache(checkpointPath)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if actual := checkpoint.Len(); actual != 4 {
+		t.Fatalf("Expected=4 checkpointed checksums vs. Actual=%d", actual)
+	}
+
+	cache := newHashCache(filepath.Join(t.TempDir(), "hashes.json"))
+	resumed, err := findDuplicateFiles(t.Context(), []string{tempDir}, scanOptions{Jobs: 1, Cache: cache, Checkpoint: checkpoint})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if hits, _ := checkpoint.Stats(); hits != 4 {
+		t.Errorf("Expected=4 checkpoint hits vs. Actual=%d", hits)
+	}
+	// the checksums from the checkpoint are kept in the cache along with the rest.
+	if actual := cache.Len(); actual != 16 {
+		t.Errorf("Expected=16 cached checksums vs. Actual=%d", actual)
+	}
+	if _, err := os.Stat(checkpointPath); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Expected the checkpoint to be removed vs. Actual=%v", err)
+	}
+
+	expected, err := findDuplicateFiles(t.Context(), []string{tempDir}, scanOptions{Jobs: 1})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(resumed.Groups) != len(expected.Groups) {
+		t.Fatalf("Expected=%d groups vs. Actual=%d", len(expected.Groups), len(resumed.Groups))
+	}
+	for index, group := range expected.Groups {
+		actual := resumed.Groups[index]
+		if actual.Checksum != group.Checksum || !slices.EqualFunc(actual.Files, group.Files, func(a, b fullFileInfo) bool { return a.Path == b.Path }) {
+			t.Errorf("Input=%d Expected=%s %v vs. Actual=%s %v", index, group.Checksum, group.Files, actual.Checksum, actual.Files)
+		}
+	}
+}
+
+func Test_normalizeRoots(t *testing.T) {
+	tempDir := t.TempDir()
+	for _, dir := range []string{"a/nested", "b"} {
+		if err := os.MkdirAll(filepath.Join(tempDir, dir), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	a, nested, b := filepath.Join(tempDir, "a"), filepath.Join(tempDir, "a", "nested"), filepath.Join(tempDir, "b")
+
+	testCases := [...]struct {
+		Input    []string
+		Expected []string
+	}{
+		{[]string{a, b}, []string{a, b}},
+		{[]string{a, a + "/", b}, []string{a, b}},
+		{[]string{nested, a}, []string{a}},
+		{[]string{b, nested}, []string{b, nested}},
+	}
+
+	for _, tc := range testCases {
+		actual, err := normalizeRoots(tc.Input)
+		if err != nil {
+			t.Errorf("unexpected error: %v", err)
+			continue
+		}
+		if !slices.Equal(actual, tc.Expected) {
+			t.Errorf("Input=%v Expected=%v vs. Actual=%v", tc.Input, tc.Expected, actual)
+		}
+	}
+}
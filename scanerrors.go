@@ -0,0 +1,100 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"slices"
+	"strings"
+
+	"github.com/wcharczuk/space-saver/pkg/filesize"
+	"golang.org/x/sys/unix"
+)
+
+// errSkipped is returned by hash functions for files whose error has already been recorded
+// and which should be left out of the results without failing the scan.
+var errSkipped = errors.New("skipped")
+
+// errorCategory is a broad classification of why a path was skipped.
+type errorCategory int
+
+const (
+	errorPermissionDenied errorCategory = iota
+	errorVanished
+	errorIO
+	errorTooManySymlinks
+	errorOther
+	errorCategoryCount // must be last
+)
+
+func (ec errorCategory) String() string {
+	switch ec {
+	case errorPermissionDenied:
+		return "permission denied"
+	case errorVanished:
+		return "vanished"
+	case errorIO:
+		return "i/o error"
+	case errorTooManySymlinks:
+		return "too many symlinks"
+	case errorOther:
+		return "other"
+	default:
+		return fmt.Sprintf("unknown(%d)", int(ec))
+	}
+}
+
+// categorizeError returns the category of an error encountered while scanning a path.
+func categorizeError(err error) errorCategory {
+	switch {
+	case errors.Is(err, fs.ErrPermission):
+		return errorPermissionDenied
+	case errors.Is(err, fs.ErrNotExist):
+		return errorVanished
+	case errors.Is(err, unix.ELOOP):
+		return errorTooManySymlinks
+	case errors.Is(err, unix.EIO):
+		return errorIO
+	default:
+		return errorOther
+	}
+}
+
+// scanError is a path that was skipped because of an error.
+type scanError struct {
+	Path     string
+	Category errorCategory
+	// Bytes is the size of the skipped file, if it's known.
+	Bytes uint64
+	Err   error
+}
+
+// sortScanErrors sorts errors by path so they're reported in a stable order.
+func sortScanErrors(scanErrors []scanError) {
+	slices.SortFunc(scanErrors, func(a, b scanError) int {
+		return strings.Compare(a.Path, b.Path)
+	})
+}
+
+// printScanErrors writes the skipped paths and a summary of them by category.
+func printScanErrors(w io.Writer, scanErrors []scanError) {
+	if len(scanErrors) == 0 {
+		return
+	}
+	var counts [errorCategoryCount]int
+	var bytes [errorCategoryCount]uint64
+	fmt.Fprintln(w, "Skipped paths:")
+	for _, se := range scanErrors {
+		counts[se.Category]++
+		bytes[se.Category] += se.Bytes
+		fmt.Fprintf(w, "\t%s (%v); %v\n", se.Path, se.Category, se.Err)
+	}
+	fmt.Fprintln(w, "Skipped summary:")
+	for category := range errorCategoryCount {
+		if counts[category] == 0 {
+			continue
+		}
+		fmt.Fprintf(w, "\t%v: %d (%s)\n", category, counts[category], filesize.FormatFraction(bytes[category]))
+	}
+}
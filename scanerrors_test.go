@@ -0,0 +1,32 @@
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func Test_categorizeError(t *testing.T) {
+	testCases := [...]struct {
+		Input    error
+		Expected errorCategory
+	}{
+		{&fs.PathError{Op: "open", Path: "a", Err: unix.EACCES}, errorPermissionDenied},
+		{&fs.PathError{Op: "open", Path: "a", Err: unix.EPERM}, errorPermissionDenied},
+		{&fs.PathError{Op: "lstat", Path: "a", Err: unix.ENOENT}, errorVanished},
+		{&fs.PathError{Op: "open", Path: "a", Err: unix.ELOOP}, errorTooManySymlinks},
+		{&fs.PathError{Op: "read", Path: "a", Err: unix.EIO}, errorIO},
+		{fmt.Errorf("checksum failed; %w", os.ErrNotExist), errorVanished},
+		{fmt.Errorf("something else"), errorOther},
+	}
+
+	for _, tc := range testCases {
+		actual := categorizeError(tc.Input)
+		if actual != tc.Expected {
+			t.Errorf("Input=%v Expected=%v vs. Actual=%v", tc.Input, tc.Expected, actual)
+		}
+	}
+}
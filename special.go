@@ -0,0 +1,114 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// errNotRegular is returned when a path we expected to be a regular file turns out not to be.
+var errNotRegular = errors.New("not a regular file")
+
+// specialKind is the kind of a non-regular file that the walk skips.
+type specialKind int
+
+const (
+	specialSymlink specialKind = iota
+	specialNamedPipe
+	specialSocket
+	specialDevice
+	specialOther
+	// specialRepeatedDir is a followed symlink to a directory that's already been walked,
+	// which is how symlink loops are broken.
+	specialRepeatedDir
+	// specialBrokenSymlink is a followed symlink whose target doesn't exist.
+	specialBrokenSymlink
+	specialKindCount // must be last
+)
+
+func (sk specialKind) String() string {
+	switch sk {
+	case specialSymlink:
+		return "symlinks"
+	case specialNamedPipe:
+		return "named pipes"
+	case specialSocket:
+		return "sockets"
+	case specialDevice:
+		return "devices"
+	case specialOther:
+		return "other"
+	case specialRepeatedDir:
+		return "symlinks to directories already scanned"
+	case specialBrokenSymlink:
+		return "broken symlinks"
+	default:
+		return fmt.Sprintf("unknown(%d)", int(sk))
+	}
+}
+
+// specialKindOf returns the kind of a non-regular file from its mode.
+func specialKindOf(mode fs.FileMode) specialKind {
+	switch {
+	case mode&fs.ModeSymlink != 0:
+		return specialSymlink
+	case mode&fs.ModeNamedPipe != 0:
+		return specialNamedPipe
+	case mode&fs.ModeSocket != 0:
+		return specialSocket
+	case mode&fs.ModeDevice != 0:
+		return specialDevice
+	default:
+		return specialOther
+	}
+}
+
+// specialCounts are the number of special files of each kind that were skipped.
+type specialCounts [specialKindCount]int
+
+// Total returns the number of special files skipped.
+func (sc specialCounts) Total() (total int) {
+	for _, count := range sc {
+		total += count
+	}
+	return
+}
+
+// printSpecialCounts writes the number of special files that were skipped by kind.
+func printSpecialCounts(w io.Writer, sc specialCounts) {
+	if sc.Total() == 0 {
+		return
+	}
+	fmt.Fprintln(w, "Skipped special files:")
+	for kind, count := range sc {
+		if count == 0 {
+			continue
+		}
+		fmt.Fprintf(w, "\t%v: %d\n", specialKind(kind), count)
+	}
+}
+
+// openRegular opens a file for reading, failing if it isn't a regular file.
+//
+// The walk only considers regular files, but a path can be replaced between the walk and it being read,
+// so we open without blocking (e.g. on a named pipe with no writer) and check what we actually opened.
+func openRegular(path string) (*os.File, error) {
+	f, err := os.OpenFile(path, os.O_RDONLY|unix.O_NONBLOCK, 0)
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	if !info.Mode().IsRegular() {
+		_ = f.Close()
+		return nil, &fs.PathError{Op: "open", Path: path, Err: errNotRegular}
+	}
+	return f, nil
+}
@@ -0,0 +1,29 @@
+package main
+
+import "io/fs"
+
+// fileStat are the fields of the platform specific stat structure that we care about.
+type fileStat struct {
+	Dev   uint64
+	Ino   uint64
+	Nlink uint64
+	Uid   uint32
+	Gid   uint32
+	// Blocks is the number of 512 byte blocks allocated on disk.
+	Blocks int64
+	// Atime is the access time in nanoseconds since the epoch.
+	Atime int64
+	// Ctime is the status change time in nanoseconds since the epoch.
+	Ctime int64
+}
+
+// statOf returns the platform specific stat fields of a file info, if it has them.
+func statOf(info fs.FileInfo) (fileStat, bool) {
+	if info == nil {
+		return fileStat{}, false
+	}
+	if ffi, ok := info.(fullFileInfo); ok {
+		info = ffi.FileInfo
+	}
+	return platformStatOf(info)
+}
@@ -0,0 +1,23 @@
+package main
+
+import (
+	"io/fs"
+	"syscall"
+)
+
+func platformStatOf(info fs.FileInfo) (fileStat, bool) {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return fileStat{}, false
+	}
+	return fileStat{
+		Dev:    uint64(st.Dev),
+		Ino:    st.Ino,
+		Nlink:  uint64(st.Nlink),
+		Uid:    st.Uid,
+		Gid:    st.Gid,
+		Blocks: st.Blocks,
+		Atime:  st.Atimespec.Nano(),
+		Ctime:  st.Ctimespec.Nano(),
+	}, true
+}
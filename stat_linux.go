@@ -0,0 +1,23 @@
+package main
+
+import (
+	"io/fs"
+	"syscall"
+)
+
+func platformStatOf(info fs.FileInfo) (fileStat, bool) {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return fileStat{}, false
+	}
+	return fileStat{
+		Dev:    uint64(st.Dev),
+		Ino:    uint64(st.Ino),
+		Nlink:  uint64(st.Nlink),
+		Uid:    st.Uid,
+		Gid:    st.Gid,
+		Blocks: int64(st.Blocks),
+		Atime:  st.Atim.Nano(),
+		Ctime:  st.Ctim.Nano(),
+	}, true
+}
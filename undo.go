@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"github.com/wcharczuk/space-saver/pkg/filesize"
+)
+
+// undoOutcome is what happened when we tried to undo a journal entry.
+type undoOutcome int
+
+const (
+	undoUnshared undoOutcome = iota
+	undoAlreadyIndependent
+	undoMissing
+	undoFailed
+	undoOutcomeCount // must be last
+)
+
+func (uo undoOutcome) String() string {
+	switch uo {
+	case undoUnshared:
+		return "unshared"
+	case undoAlreadyIndependent:
+		return "already-independent"
+	case undoMissing:
+		return "missing"
+	case undoFailed:
+		return "failed"
+	default:
+		return fmt.Sprintf("unknown(%d)", int(uo))
+	}
+}
+
+// undoResult is the recorded outcome of undoing a single journal entry.
+type undoResult struct {
+	Entry   journalEntry
+	Outcome undoOutcome
+	// Metadata is the metadata of the target that couldn't be restored onto its copy.
+	Metadata []metadataProblem
+	Err      error
+}
+
+// undoEntry makes the target of a journal entry an independent copy again, if it still shares storage with its source.
+//
+// If whether it still shares storage can't be determined (e.g. extents can't be inspected), it's copied anyway.
+func undoEntry(ctx context.Context, entry journalEntry, real bool) (result undoResult) {
+	result.Entry = entry
+	targetInfo, err := os.Stat(entry.Target)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			result.Outcome = undoMissing
+			return
+		}
+		result.Outcome, result.Err = undoFailed, err
+		return
+	}
+	if sourceInfo, err := os.Stat(entry.Source); err == nil && !os.SameFile(sourceInfo, targetInfo) {
+		sharing, err := fileSharing(fullFileInfo{Path: entry.Source, FileInfo: sourceInfo}, fullFileInfo{Path: entry.Target, FileInfo: targetInfo})
+		// without extents (i.e. on darwin) no sharing is ever found, which doesn't mean there isn't any.
+		if err == nil && extentsSupported && sharing.Kind() == sharingNone {
+			result.Outcome = undoAlreadyIndependent
+			return
+		}
+	}
+	if !real {
+		result.Outcome = undoUnshared
+		return
+	}
+	result.Metadata, err = unshareFile(ctx, entry.Target, targetInfo)
+	if err != nil {
+		result.Outcome, result.Err = undoFailed, err
+		return
+	}
+	result.Outcome = undoUnshared
+	return
+}
+
+// unshareFile replaces a file with an independent copy of itself, with its metadata restored.
+//
+// Like cloneFile, the copy is made into a temporary sibling which is then renamed over the file.
+func unshareFile(ctx context.Context, path string, info fs.FileInfo) (problems []metadataProblem, err error) {
+	tempPath, err := tempSiblingPath(path)
+	if err != nil {
+		return nil, fmt.Errorf("undo failed: unable to create temporary path; %w", err)
+	}
+	if err := copyFileContents(ctx, path, tempPath); err != nil {
+		return nil, fmt.Errorf("undo failed: %w", err)
+	}
+	problems = restoreMetadata(info, path, tempPath)
+	if err := os.Rename(tempPath, path); err != nil {
+		_ = os.Remove(tempPath)
+		return nil, fmt.Errorf("undo failed: unable to replace file; %w", err)
+	}
+	if err := syncDir(filepath.Dir(path)); err != nil {
+		return problems, fmt.Errorf("undo failed: unable to sync directory; %w", err)
+	}
+	return problems, nil
+}
+
+// copyFileContents creates target with a byte for byte copy of source.
+//
+// The files are wrapped so that io.Copy can't use copy_file_range(2), which may
+// share extents (i.e. clone) rather than copy them on filesystems that support it.
+func copyFileContents(ctx context.Context, source, target string) error {
+	sourceFile, err := os.Open(source)
+	if err != nil {
+		return err
+	}
+	defer sourceFile.Close()
+	targetFile, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(struct{ io.Writer }{targetFile}, contextReader{ctx, sourceFile}); err != nil {
+		_ = targetFile.Close()
+		_ = os.Remove(target)
+		return err
+	}
+	if err := targetFile.Sync(); err != nil {
+		_ = targetFile.Close()
+		_ = os.Remove(target)
+		return err
+	}
+	if err := targetFile.Close(); err != nil {
+		_ = os.Remove(target)
+		return err
+	}
+	return nil
+}
+
+// undoSummary tallies undo results by outcome.
+type undoSummary struct {
+	Counts [undoOutcomeCount]int
+	Bytes  [undoOutcomeCount]uint64
+}
+
+// Add records an undo result.
+func (s *undoSummary) Add(result undoResult) {
+	s.Counts[result.Outcome]++
+	s.Bytes[result.Outcome] += uint64(max(result.Entry.Size, 0))
+}
+
+// Print writes the per outcome counts and bytes.
+func (s *undoSummary) Print(w io.Writer) {
+	fmt.Fprintln(w, "Outcomes:")
+	for outcome := range undoOutcomeCount {
+		fmt.Fprintf(w, "\t%s: %d (%s)\n", outcome, s.Counts[outcome], filesize.FormatFraction(s.Bytes[outcome]))
+	}
+}
+
+func printUndoResult(w io.Writer, result undoResult, real bool) {
+	target := truncateStringPrefix(result.Entry.Target, 64)
+	switch {
+	case result.Outcome == undoUnshared && !real:
+		fmt.Fprintf(w, "[DRY-RUN] Would copy %s (%s from %s)\n", target, result.Entry.Method, truncateStringPrefix(result.Entry.Source, 64))
+	case result.Outcome == undoUnshared:
+		fmt.Fprintf(w, "Copied %s\n", target)
+		printMetadataProblems(w, result.Metadata)
+	case result.Outcome == undoFailed:
+		fmt.Fprintf(w, "Failed to copy %s; %v\n", target, result.Err)
+	default:
+		fmt.Fprintf(w, "Skipped %s (%v)\n", target, result.Outcome)
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func Test_filesEqual(t *testing.T) {
+	tempDir := t.TempDir()
+	big := bytes.Repeat([]byte("0123456789abcdef"), (3*verifyBufferSize)/16)
+	bigChanged := bytes.Clone(big)
+	bigChanged[len(big)-1] = 'x'
+
+	testCases := [...]struct {
+		A        []byte
+		B        []byte
+		Expected bool
+	}{
+		{nil, nil, true},
+		{[]byte("hello"), []byte("hello"), true},
+		{[]byte("hello"), []byte("hellO"), false},
+		{[]byte("hello"), []byte("hello world"), false},
+		{big, big, true},
+		{big, bigChanged, false},
+		{big, big[:len(big)-1], false},
+	}
+
+	for index, tc := range testCases {
+		a, b := filepath.Join(tempDir, "a"), filepath.Join(tempDir, "b")
+		if err := os.WriteFile(a, tc.A, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(b, tc.B, 0644); err != nil {
+			t.Fatal(err)
+		}
+		actual, err := filesEqual(t.Context(), a, b)
+		if err != nil {
+			t.Errorf("unexpected error: %v", err)
+			continue
+		}
+		if actual != tc.Expected {
+			t.Errorf("Case=%d Expected=%v vs. Actual=%v", index, tc.Expected, actual)
+		}
+	}
+}